@@ -3,19 +3,22 @@ package main
 import (
 	"html/template"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 type Link struct {
-	URL     string
-	Title   string
-	Tags    map[string]string
-	Elapsed string
-	Generic bool
+	URL     string            `json:"url"`
+	Title   string            `json:"title"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Elapsed string            `json:"elapsed,omitempty"`
+	Generic bool              `json:"generic,omitempty"`
 }
 
 const mainPath = "webroot/configs"
@@ -26,52 +29,68 @@ func serveBaseHTML(template *template.Template, w http.ResponseWriter, r *http.R
 		return err
 	}
 
-	links := []Link{}
+	configs := []string{}
 	for _, file := range files {
 		if filepath.Ext(file.Name()) == ".json" {
-			config := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-			title := strings.Title(strings.Replace(strings.Replace(config, "-", " ", -1), "_", " ", -1))
-			links = append(links, Link{
-				URL:     "?config=" + config,
-				Title:   title,
-				Generic: true,
-			})
-
-			if bookie, ok := newBookieFromConfigFilePath(mainPath + "/" + file.Name()); ok {
-				fsms := []fsm{}
-				if f, err := bookie.latestFSMs(10); err == nil {
-					fsms = f
-				}
+			configs = append(configs, strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())))
+		}
+	}
 
-				l := len(fsms)
-				for i := range fsms {
-					fsm := fsms[l-i-1]
-					elapsed := ""
-					_created, err := time.Parse("2006-01-02T15:04:05Z", fsm.Created)
-					if err == nil {
-						elapsed = durationRound(time.Now().UTC().Sub(_created), time.Second).String()
-					}
-
-					links = append(links, Link{
-						URL:     "?config=" + config + "&fsmId=" + fsm.Id,
-						Title:   title + " > " + fsm.Id,
-						Elapsed: elapsed + " ago",
-						Tags:    fsm.Tags,
-					})
+	// Bookie lookups are slow compared to everything else, so do them concurrently.
+	latest := make([][]fsm, len(configs))
+	var wg sync.WaitGroup
+	for i, config := range configs {
+		logger := log.WithFields(log.Fields{"config": config})
+		if b, ok := newBookieFromConfigFilePath(mainPath+"/"+config+".json", logger); ok {
+			wg.Add(1)
+			go func(i int, b bookie) {
+				defer wg.Done()
+				fsms, err := b.latestFSMs(10)
+				if err != nil {
+					b.log.WithFields(log.Fields{"err": err, "url": b.url}).Warn("Failed to fetch latest FSMs from Bookie.")
 				}
-			}
+				latest[i] = fsms
+			}(i, b)
+		}
+	}
+	wg.Wait()
+
+	links := []Link{}
+	for i, config := range configs {
+		links = append(links, Link{
+			URL:     "/?config=" + config,
+			Title:   configTitle(config),
+			Generic: true,
+		})
+
+		fsms := latest[i]
+		l := len(fsms)
+		for i := range fsms {
+			links = append(links, fsmLink(config, fsms[l-i-1]))
 		}
 	}
 
 	return template.Execute(w, links)
 }
 
-func mustParseBasePageTemplate() *template.Template {
-	template, err := parseBasePageTemplate()
-	if err != nil {
-		log.Fatalf("Could not parse base page template. err=%v", err)
+func configTitle(config string) string {
+	return strings.Title(strings.Replace(strings.Replace(config, "-", " ", -1), "_", " ", -1))
+}
+
+// fsmLink links to a session of the given config pre-seeded with the FSM's id.
+func fsmLink(config string, fsm fsm) Link {
+	elapsed := ""
+	_created, err := time.Parse("2006-01-02T15:04:05Z", fsm.Created)
+	if err == nil {
+		elapsed = durationRound(time.Now().UTC().Sub(_created), time.Second).String()
+	}
+
+	return Link{
+		URL:     "/?config=" + url.QueryEscape(config) + "&fsmId=" + url.QueryEscape(fsm.Id),
+		Title:   configTitle(config) + " > " + fsm.Id,
+		Elapsed: elapsed + " ago",
+		Tags:    fsm.Tags,
 	}
-	return template
 }
 
 func parseBasePageTemplate() (*template.Template, error) {
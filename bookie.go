@@ -2,17 +2,59 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	bookieToken    = flag.String("bookie-token", "", "bearer token for Bookie (defaults to $BOOKIE_TOKEN)")
+	bookieUser     = flag.String("bookie-user", "", "basic auth user for Bookie (defaults to $BOOKIE_USER)")
+	bookiePassword = flag.String("bookie-password", "", "basic auth password for Bookie (defaults to $BOOKIE_PASSWORD)")
+	bookieTimeout  = flag.Duration("bookie-timeout", 5*time.Second, "timeout for each request to Bookie")
+	bookieRetries  = flag.Int("bookie-retries", 2, "how many times to retry failed requests to Bookie")
+	bookieCacheTTL = flag.Duration("bookie-cache-ttl", 10*time.Second, "how long to cache Bookie responses")
 )
 
+// sharedBookieCache is used by all bookies created through newBookie, so that
+// page loads and sessions reuse each other's responses.
+var sharedBookieCache = newBookieCache()
+
+type bookieAuth struct {
+	token    string
+	user     string
+	password string
+}
+
 type bookie struct {
-	url string
+	url     string
+	client  *http.Client
+	auth    bookieAuth
+	retries int
+	backoff time.Duration
+	ttl     time.Duration
+	cache   *bookieCache
+	log     *log.Entry
+}
+
+type bookieStatusError struct {
+	url    string
+	status int
+	body   string
+}
+
+func (e bookieStatusError) Error() string {
+	return fmt.Sprintf("Bookie responded %v to %v: %v", e.status, e.url, e.body)
 }
 
 type partition struct {
@@ -40,28 +82,106 @@ func (b bookie) fsm(fsmId string) (fsm, error) {
 		return f, fmt.Errorf("bookie is not enabled")
 	}
 
-	client := http.Client{Timeout: time.Duration(5 * time.Second)}
-	r, err := client.Get(fmt.Sprintf("%v/fsm?id=%v", b.url, fsmId))
-	if err != nil {
-		return f, err
-	}
-	defer r.Body.Close()
-
-	err = json.NewDecoder(r.Body).Decode(&f)
+	err := b.get(fmt.Sprintf("/fsm?id=%v", url.QueryEscape(fsmId)), &f)
 	return f, err
 }
 
-func newBookie(url string) bookie {
+func newBookie(url string, logger *log.Entry) bookie {
 	if !strings.HasPrefix(url, "http") {
 		url = "http://" + url
 	}
-	return bookie{url: url}
+	return bookie{
+		url:     strings.TrimSuffix(url, "/"),
+		client:  &http.Client{Timeout: *bookieTimeout},
+		auth:    bookieAuth{token: orEnv(*bookieToken, "BOOKIE_TOKEN"), user: orEnv(*bookieUser, "BOOKIE_USER"), password: orEnv(*bookiePassword, "BOOKIE_PASSWORD")},
+		retries: *bookieRetries,
+		backoff: 200 * time.Millisecond,
+		ttl:     *bookieCacheTTL,
+		cache:   sharedBookieCache,
+		log:     logger,
+	}
+}
+
+// orEnv returns v, or the environment variable if v is empty. Secrets are
+// read this way rather than as flag defaults, so that -h doesn't print them.
+func orEnv(v string, key string) string {
+	if v == "" {
+		return os.Getenv(key)
+	}
+	return v
+}
+
+// get fetches path from Bookie and decodes the JSON response into v, going
+// through the cache and retrying with exponential backoff on network errors
+// and 5xx or 429 responses.
+func (b bookie) get(path string, v interface{}) error {
+	u := b.url + path
+	if raw, ok := b.cache.get(u); ok {
+		return json.Unmarshal(raw, v)
+	}
+
+	var err error
+	for attempt := 0; attempt <= b.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(b.backoff << uint(attempt-1))
+		}
+
+		var raw []byte
+		var retry bool
+		raw, retry, err = b.do(u)
+		if err == nil {
+			if err = json.Unmarshal(raw, v); err == nil {
+				b.cache.set(u, raw, b.ttl)
+			}
+			return err
+		}
+		if !retry {
+			break
+		}
+		b.log.WithFields(log.Fields{"err": err, "attempt": attempt + 1, "url": u}).Warn("Request to Bookie failed.")
+	}
+	return err
+}
+
+func (b bookie) do(u string) ([]byte, bool, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if b.auth.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.auth.token)
+	} else if b.auth.user != "" {
+		req.SetBasicAuth(b.auth.user, b.auth.password)
+	}
+
+	client := b.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer r.Body.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		return nil, true, err
+	}
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		retry := r.StatusCode >= 500 || r.StatusCode == http.StatusTooManyRequests
+		return nil, retry, bookieStatusError{url: u, status: r.StatusCode, body: strings.TrimSpace(string(raw))}
+	}
+
+	return raw, false, nil
 }
 
-func newBookieFromConfigFilePath(path string) (bookie, bool) {
+func newBookieFromConfigFilePath(path string, logger *log.Entry) (bookie, bool) {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Println(err)
+		logger.WithFields(log.Fields{"err": err, "path": path}).Warn("Could not read config.")
 		return bookie{}, false
 	}
 
@@ -74,26 +194,59 @@ func newBookieFromConfigFilePath(path string) (bookie, bool) {
 		return bookie{}, false
 	}
 
-	return newBookie(c.BookieURL), true
+	return newBookie(c.BookieURL, logger), true
 }
 
 func (b bookie) latestFSMs(n int) ([]fsm, error) {
 	if len(b.url) == 0 {
 		return []fsm{}, fmt.Errorf("bookie is not enabled")
 	}
+
 	fsms := []fsm{}
-	client := http.Client{Timeout: time.Duration(5 * time.Second)}
-	r, err := client.Get(fmt.Sprintf("%v/latest?n=%v", b.url, n))
-	if err != nil {
-		return fsms, err
+	if err := b.get(fmt.Sprintf("/latest?n=%v", n), &fsms); err != nil {
+		return []fsm{}, err
 	}
-	defer r.Body.Close()
+	return fsms, nil
+}
+
+// fsmQuery narrows a search for FSMs on Bookie. Zero values don't filter.
+type fsmQuery struct {
+	tags   map[string]string
+	from   time.Time // created at or after
+	to     time.Time // created at or before
+	prefix string    // of the FSM id
+	n      int
+}
+
+func (q fsmQuery) values() url.Values {
+	v := url.Values{}
+	for k, t := range q.tags {
+		v.Add("tag", k+":"+t)
+	}
+	if !q.from.IsZero() {
+		v.Set("from", q.from.UTC().Format(time.RFC3339))
+	}
+	if !q.to.IsZero() {
+		v.Set("to", q.to.UTC().Format(time.RFC3339))
+	}
+	if q.prefix != "" {
+		v.Set("prefix", q.prefix)
+	}
+	if q.n > 0 {
+		v.Set("n", strconv.Itoa(q.n))
+	}
+	return v
+}
 
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&fsms); err != nil {
-		return fsms, err
+func (b bookie) search(q fsmQuery) ([]fsm, error) {
+	if len(b.url) == 0 {
+		return []fsm{}, fmt.Errorf("bookie is not enabled")
 	}
 
+	fsms := []fsm{}
+	if err := b.get("/search?"+q.values().Encode(), &fsms); err != nil {
+		return []fsm{}, err
+	}
 	return fsms, nil
 }
 
@@ -116,3 +269,66 @@ func (f fsm) offset(topic string, partition int32) (int64, bool) {
 
 	return o.Start, true
 }
+
+type bookieCacheEntry struct {
+	raw     []byte
+	expires time.Time
+}
+
+type bookieCache struct {
+	entries map[string]bookieCacheEntry
+	l       sync.Mutex
+}
+
+func newBookieCache() *bookieCache {
+	return &bookieCache{entries: map[string]bookieCacheEntry{}}
+}
+
+func (c *bookieCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.raw, true
+}
+
+func (c *bookieCache) set(key string, raw []byte, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = bookieCacheEntry{raw: raw, expires: now.Add(ttl)}
+}
+
+// partitions returns what Bookie knows about the FSM on each partition of the
+// topic, if anything.
+func (f fsm) partitions(topic string) (map[int32]partition, bool) {
+	t, ok := f.Topics[topic]
+	if !ok || len(t.Partitions) == 0 {
+		return nil, false
+	}
+
+	ps := map[int32]partition{}
+	for k, p := range t.Partitions {
+		n, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		ps[int32(n)] = p
+	}
+	return ps, len(ps) > 0
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fakeBookie is an in-memory Bookie server for tests.
+type fakeBookie struct {
+	*httptest.Server
+
+	l        sync.Mutex
+	fsms     map[string]fsm
+	latest   []fsm
+	token    string // if set, requests must carry it as a bearer token
+	failures int    // how many of the next requests should fail with a 503
+	requests int
+}
+
+func newFakeBookie() *fakeBookie {
+	fb := &fakeBookie{fsms: map[string]fsm{}}
+	fb.Server = httptest.NewServer(http.HandlerFunc(fb.handle))
+	return fb
+}
+
+// Close shuts the fake down along with the connections clients kept to it.
+func (fb *fakeBookie) Close() {
+	fb.Server.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+}
+
+func (fb *fakeBookie) handle(w http.ResponseWriter, r *http.Request) {
+	fb.l.Lock()
+	defer fb.l.Unlock()
+	fb.requests++
+
+	if fb.token != "" && r.Header.Get("Authorization") != "Bearer "+fb.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if fb.failures > 0 {
+		fb.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/fsm":
+		f, ok := fb.fsms[r.URL.Query().Get("id")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(f)
+	case "/latest":
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		if n > len(fb.latest) {
+			n = len(fb.latest)
+		}
+		json.NewEncoder(w).Encode(fb.latest[:n])
+	case "/search":
+		json.NewEncoder(w).Encode(fb.searchFSMs(r.URL.Query()))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (fb *fakeBookie) searchFSMs(q url.Values) []fsm {
+	from, _ := time.Parse(time.RFC3339, q.Get("from"))
+	to, _ := time.Parse(time.RFC3339, q.Get("to"))
+
+	ids := []string{}
+	for id := range fb.fsms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fsms := []fsm{}
+	for _, id := range ids {
+		f := fb.fsms[id]
+		created, _ := time.Parse(time.RFC3339, f.Created)
+		match := strings.HasPrefix(f.Id, q.Get("prefix")) &&
+			(from.IsZero() || !created.Before(from)) &&
+			(to.IsZero() || !created.After(to))
+		for _, tag := range q["tag"] {
+			kv := strings.SplitN(tag, ":", 2)
+			match = match && f.Tags[kv[0]] == kv[1]
+		}
+		if match {
+			fsms = append(fsms, f)
+		}
+	}
+	return fsms
+}
+
+func (fb *fakeBookie) requestCount() int {
+	fb.l.Lock()
+	defer fb.l.Unlock()
+	return fb.requests
+}
+
+// bookie returns a client for the fake with its own cache and no backoff.
+func (fb *fakeBookie) bookie() bookie {
+	b := newBookie(fb.URL, log.NewEntry(log.StandardLogger()))
+	b.backoff = 0
+	b.cache = newBookieCache()
+	return b
+}
+
+func TestBookieFetchesFSM(t *testing.T) {
+	fb := newFakeBookie()
+	defer fb.Close()
+	expected := fsm{Id: "123", Topics: map[string]topic{"t": {Count: 3, Partitions: map[string]partition{"2": {Start: 10, End: 20, Count: 3}}}}}
+	fb.fsms["123"] = expected
+
+	actual, err := fb.bookie().fsm("123")
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v but got %+v", expected, actual)
+	}
+	if o, ok := actual.offset("t", 2); !ok || o != 10 {
+		t.Errorf("expected offset 10 for partition 2; got %v, %v", o, ok)
+	}
+}
+
+func TestBookieSendsAuth(t *testing.T) {
+	fb := newFakeBookie()
+	defer fb.Close()
+	fb.token = "secret"
+	fb.latest = []fsm{{Id: "1"}}
+
+	b := fb.bookie()
+	if _, err := b.latestFSMs(10); err == nil {
+		t.Error("expected request without token to fail")
+	}
+
+	b.auth.token = "secret"
+	fsms, err := b.latestFSMs(10)
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(fsms) != 1 || fsms[0].Id != "1" {
+		t.Errorf("expected latest FSMs [1]; got %+v", fsms)
+	}
+}
+
+func TestBookieReadsSecretsFromEnvWhenFlagsAreEmpty(t *testing.T) {
+	old := os.Getenv("BOOKIE_TOKEN")
+	defer os.Setenv("BOOKIE_TOKEN", old)
+	os.Setenv("BOOKIE_TOKEN", "from-env")
+
+	if b := newBookie("http://bookie", log.NewEntry(log.StandardLogger())); b.auth.token != "from-env" {
+		t.Errorf("expected token from $BOOKIE_TOKEN; got %q", b.auth.token)
+	}
+
+	*bookieToken = "from-flag"
+	defer func() { *bookieToken = "" }()
+	if b := newBookie("http://bookie", log.NewEntry(log.StandardLogger())); b.auth.token != "from-flag" {
+		t.Errorf("expected -bookie-token to take precedence; got %q", b.auth.token)
+	}
+}
+
+func TestBookieRetriesServerErrors(t *testing.T) {
+	fb := newFakeBookie()
+	defer fb.Close()
+	fb.fsms["123"] = fsm{Id: "123"}
+	fb.failures = 2
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	b := fb.bookie()
+	b.log = logger.WithFields(log.Fields{"session": "s1"})
+	b.retries = 2
+	if _, err := b.fsm("123"); err != nil {
+		t.Fatalf("expected to succeed after retrying, but failed with %v", err)
+	}
+	if fb.requestCount() != 3 {
+		t.Errorf("expected 3 requests but got %v", fb.requestCount())
+	}
+	if n := strings.Count(out.String(), "session=s1"); n != 2 {
+		t.Errorf("expected both failed attempts to be logged with the caller's fields; got %q", out.String())
+	}
+
+	fb.failures = 3
+	_, err := fb.bookie().fsm("123")
+	if se, ok := err.(bookieStatusError); !ok || se.status != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 status error after running out of retries; got %v", err)
+	}
+}
+
+func TestBookieDoesntRetryClientErrors(t *testing.T) {
+	fb := newFakeBookie()
+	defer fb.Close()
+
+	_, err := fb.bookie().fsm("missing")
+	if se, ok := err.(bookieStatusError); !ok || se.status != http.StatusNotFound {
+		t.Errorf("expected a 404 status error; got %v", err)
+	}
+	if fb.requestCount() != 1 {
+		t.Errorf("expected a single request but got %v", fb.requestCount())
+	}
+}
+
+func TestBookieCachesResponses(t *testing.T) {
+	fb := newFakeBookie()
+	defer fb.Close()
+	fb.latest = []fsm{{Id: "1"}, {Id: "2"}}
+
+	b := fb.bookie()
+	b.ttl = time.Minute
+	for i := 0; i < 3; i++ {
+		if _, err := b.latestFSMs(10); err != nil {
+			t.Fatalf("shouldn't have failed, but did with %v", err)
+		}
+	}
+	if fb.requestCount() != 1 {
+		t.Errorf("expected cached responses after the first request; got %v requests", fb.requestCount())
+	}
+
+	b.ttl = 0
+	b.cache = newBookieCache()
+	b.latestFSMs(10)
+	b.latestFSMs(10)
+	if fb.requestCount() != 3 {
+		t.Errorf("expected no caching with a zero TTL; got %v requests", fb.requestCount())
+	}
+}
+
+func TestBookieSearch(t *testing.T) {
+	fb := newFakeBookie()
+	defer fb.Close()
+	fb.fsms["order-1"] = fsm{Id: "order-1", Created: "2017-01-01T10:00:00Z", Tags: map[string]string{"user": "alice"}}
+	fb.fsms["order-2"] = fsm{Id: "order-2", Created: "2017-01-02T10:00:00Z", Tags: map[string]string{"user": "bob"}}
+	fb.fsms["refund-1"] = fsm{Id: "refund-1", Created: "2017-01-03T10:00:00Z", Tags: map[string]string{"user": "alice"}}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "no filters", query: "", expected: []string{"order-1", "order-2", "refund-1"}},
+		{name: "by tag", query: "tag=user:alice", expected: []string{"order-1", "refund-1"}},
+		{name: "by prefix", query: "prefix=order", expected: []string{"order-1", "order-2"}},
+		{name: "by time range", query: "from=2017-01-02T00:00:00Z&to=2017-01-02T23:59:59Z", expected: []string{"order-2"}},
+		{name: "combined", query: "tag=user:alice&prefix=refund", expected: []string{"refund-1"}},
+	}
+
+	for _, ts := range tests {
+		v, _ := url.ParseQuery(ts.query)
+		q, err := parseFSMQuery(v)
+		if err != nil {
+			t.Fatalf("on '%v': shouldn't have failed parsing, but did with %v", ts.name, err)
+		}
+
+		fsms, err := fb.bookie().search(q)
+		if err != nil {
+			t.Fatalf("on '%v': shouldn't have failed, but did with %v", ts.name, err)
+		}
+		actual := []string{}
+		for _, f := range fsms {
+			actual = append(actual, f.Id)
+		}
+		if !reflect.DeepEqual(actual, ts.expected) {
+			t.Errorf("on '%v': expected %v but got %v", ts.name, ts.expected, actual)
+		}
+	}
+}
+
+func TestFSMLinkIsAbsolute(t *testing.T) {
+	l := fsmLink("my-orders", fsm{Id: "order 1"})
+	if expected := "/?config=my-orders&fsmId=order+1"; l.URL != expected {
+		t.Errorf("expected link %v; got %v", expected, l.URL)
+	}
+}
+
+func TestParseFSMQueryRejectsInvalidInput(t *testing.T) {
+	for _, query := range []string{"tag=nocolon", "from=yesterday", "n=0", "from=2017-01-02T00:00:00Z&to=2017-01-01T00:00:00Z"} {
+		v, _ := url.ParseQuery(query)
+		if _, err := parseFSMQuery(v); err == nil {
+			t.Errorf("expected '%v' to be rejected", query)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var bookieCountInterval = flag.Duration("bookie-count-interval", 5*time.Second, "how often to re-poll Bookie for the counts of bookieCountOnly topics during a session")
+
+// bookieCounter tracks an FSM's message counts on bookieCountOnly topics, so
+// sessions keep up with the messages Bookie sees while the FSM is still in
+// flight, rather than only showing the counts at connect time.
+type bookieCounter struct {
+	fsmId  string
+	topics []string
+	seen   map[string]map[int32]int64
+}
+
+func newBookieCounter(fsmId string, topics []string) *bookieCounter {
+	return &bookieCounter{fsmId: fsmId, topics: topics, seen: map[string]map[int32]int64{}}
+}
+
+// deltas returns a count message for every partition whose count grew since
+// the last call. Topics Bookie reports without a partition breakdown are
+// counted as a whole on partition -1.
+func (bc *bookieCounter) deltas(f fsm) []message {
+	ms := []message{}
+	for _, t := range bc.topics {
+		ti, ok := f.Topics[t]
+		if !ok {
+			continue
+		}
+		if bc.seen[t] == nil {
+			bc.seen[t] = map[int32]int64{}
+		}
+
+		counts, ok := f.partitions(t)
+		if !ok {
+			counts = map[int32]partition{-1: {Count: ti.Count}}
+		}
+
+		for p, pi := range counts {
+			if d := pi.Count - bc.seen[t][p]; d > 0 {
+				ms = append(ms, message{Topic: t, Partition: p, Count: d, FSMId: bc.fsmId, Timestamp: time.Now()})
+				bc.seen[t][p] = pi.Count
+			}
+		}
+	}
+	return ms
+}
+
+// pollBookieCounts sends the initial counts, then re-polls Bookie every so
+// often and sends whatever grew, until done is closed. Bookie's cache is
+// bypassed so that polls don't just see the connect time response again.
+func pollBookieCounts(logger *log.Entry, b bookie, bc *bookieCounter, initial fsm, every time.Duration, out chan<- []message, done <-chan struct{}) {
+	b.cache = nil
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	f := initial
+	for {
+		if ms := bc.deltas(f); len(ms) > 0 {
+			select {
+			case out <- ms:
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		var err error
+		if f, err = b.fsm(bc.fsmId); err != nil {
+			logger.WithFields(log.Fields{"err": err, "fsmId": bc.fsmId, "url": b.url}).Warn("Failed to refresh counts from Bookie.")
+		}
+	}
+}
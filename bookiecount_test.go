@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func countFSM(counts map[string]int64) fsm {
+	partitions := map[string]partition{}
+	total := int64(0)
+	for p, c := range counts {
+		partitions[p] = partition{Count: c}
+		total += c
+	}
+	return fsm{Id: "123", Topics: map[string]topic{"audit": {Count: total, Partitions: partitions}}}
+}
+
+func sumCounts(ms []message) map[int32]int64 {
+	sums := map[int32]int64{}
+	for _, m := range ms {
+		if m.FSMId == "123" && m.Topic == "audit" {
+			sums[m.Partition] += m.Count
+		}
+	}
+	return sums
+}
+
+func TestBookieCounterEmitsPerPartitionDeltas(t *testing.T) {
+	bc := newBookieCounter("123", []string{"audit", "missing"})
+
+	ts := []struct {
+		name     string
+		f        fsm
+		expected map[int32]int64
+	}{
+		{name: "initial counts", f: countFSM(map[string]int64{"0": 3, "2": 1}), expected: map[int32]int64{0: 3, 2: 1}},
+		{name: "no growth", f: countFSM(map[string]int64{"0": 3, "2": 1}), expected: map[int32]int64{}},
+		{name: "growth on one partition and a new one", f: countFSM(map[string]int64{"0": 5, "2": 1, "3": 2}), expected: map[int32]int64{0: 2, 3: 2}},
+		{name: "failed poll", f: fsm{}, expected: map[int32]int64{}},
+		{name: "no partition breakdown", f: fsm{Topics: map[string]topic{"audit": {Count: 7}}}, expected: map[int32]int64{-1: 7}},
+	}
+
+	for _, tc := range ts {
+		actual := sumCounts(bc.deltas(tc.f))
+		if len(actual) != len(tc.expected) {
+			t.Errorf("[%v] expected %v but got %v", tc.name, tc.expected, actual)
+			continue
+		}
+		for p, c := range tc.expected {
+			if actual[p] != c {
+				t.Errorf("[%v] expected %v but got %v", tc.name, tc.expected, actual)
+			}
+		}
+	}
+}
+
+func TestPollBookieCountsRefreshesWhileFSMIsInFlight(t *testing.T) {
+	fb := newFakeBookie()
+	defer fb.Close()
+	fb.fsms["123"] = countFSM(map[string]int64{"0": 1})
+
+	out, done := make(chan []message), make(chan struct{})
+	defer close(done)
+	go pollBookieCounts(log.NewEntry(log.StandardLogger()), fb.bookie(), newBookieCounter("123", []string{"audit"}), fb.fsms["123"], 10*time.Millisecond, out, done)
+
+	if c := sumCounts(<-out); c[0] != 1 {
+		t.Errorf("expected initial count of 1 on partition 0; got %v", c)
+	}
+
+	fb.l.Lock()
+	fb.fsms["123"] = countFSM(map[string]int64{"0": 4, "1": 2})
+	fb.l.Unlock()
+
+	select {
+	case ms := <-out:
+		if c := sumCounts(ms); c[0] != 3 || c[1] != 2 {
+			t.Errorf("expected deltas of 3 on partition 0 and 2 on partition 1; got %v", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timed out waiting for refreshed counts")
+	}
+}
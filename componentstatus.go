@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+var componentStatusInterval = flag.Duration("component-status-interval", 10*time.Second, "how often to send the lag of components' consumer groups to the UI; 0 disables it")
+
+// topicLag is how far a consumer group is behind on a topic, summed over its
+// partitions. Partitions the group never committed to aren't counted, so if
+// that's all of them the lag is unknown rather than 0.
+type topicLag struct {
+	Topic       string `json:"topic"`
+	Lag         int64  `json:"lag"`
+	Partitions  int    `json:"partitions"`
+	Uncommitted int    `json:"uncommitted,omitempty"` // partitions without a committed offset
+}
+
+// groupLag compares the group's committed offsets with the high-water marks
+// of every partition of its topics.
+func groupLag(client sarama.Client, group string, topics []string) ([]topicLag, error) {
+	partitions := map[string][]int32{}
+	for _, t := range topics {
+		ps, err := client.Partitions(t)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching partitions for topic %v. err=%v", t, err)
+		}
+		partitions[t] = ps
+	}
+
+	res, err := fetchCommittedOffsets(client, group, partitions)
+	if err != nil {
+		client.RefreshCoordinator(group)
+		return nil, err
+	}
+
+	lags := []topicLag{}
+	for _, t := range topics {
+		tl := topicLag{Topic: t, Partitions: len(partitions[t])}
+		for _, p := range partitions[t] {
+			block := res.GetBlock(t, p)
+			if block == nil || block.Err != sarama.ErrNoError || block.Offset < 0 {
+				tl.Uncommitted++
+				continue
+			}
+
+			hwm, err := client.GetOffset(t, p, sarama.OffsetNewest)
+			if err != nil {
+				return nil, fmt.Errorf("Error fetching the newest offset for %v/%v. err=%v", t, p, err)
+			}
+			if hwm > block.Offset {
+				tl.Lag += hwm - block.Offset
+			}
+		}
+		lags = append(lags, tl)
+	}
+	return lags, nil
+}
+
+// reportComponentStatus sends a component-status event with each component's
+// consumer group lag every so often, until stop is closed.
+func reportComponentStatus(s *session, client sarama.Client, groups []componentGroup, every time.Duration, stop chan struct{}) {
+	if every <= 0 || len(groups) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		events := []event{}
+		for _, g := range groups {
+			lags, err := groupLag(client, g.group, g.topics)
+			if err != nil {
+				s.log.WithFields(log.Fields{"err": err, "component": g.component, "group": g.group}).Warn("Could not fetch consumer group lag.")
+				continue
+			}
+			events = append(events, event{EventType: "component-status", ComponentId: g.component, Lag: lags})
+		}
+
+		if len(events) > 0 {
+			if err := s.send(events...); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
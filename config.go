@@ -2,37 +2,84 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 type consumerConfigJson struct {
-	Brokers         string `json:"brokers,omitempty"`
-	Partition       *int   `json:"partition,omitempty"`
-	Topic           string `json:"topic"`
-	Offset          string `json:"offset,omitempty"`
-	BookieCountOnly bool   `json:"bookieCountOnly,omitempty"`
+	Brokers         string                 `json:"brokers,omitempty"`
+	Partition       *int                   `json:"partition,omitempty"`
+	Topic           string                 `json:"topic"`
+	TopicRegex      string                 `json:"topicRegex,omitempty"`
+	Partitions      []int                  `json:"partitions,omitempty"`
+	Offset          string                 `json:"offset,omitempty"`
+	Offsets         map[string]interface{} `json:"offsets,omitempty"`     // by partition; numbers or offset strings
+	KeyTemplate     string                 `json:"keyTemplate,omitempty"` // how messages are keyed, e.g. {{.FSMId}}
+	Partitioner     string                 `json:"partitioner,omitempty"`
+	BookieCountOnly bool                   `json:"bookieCountOnly,omitempty"`
 }
 
 type kafka struct {
 	Brokers   string               `json:"brokers,omitempty"`
 	Consumers []consumerConfigJson `json:"consumers"`
 	Grep      string               `json:"grep"`
+	GrepRegex bool                 `json:"grepRegex,omitempty"`
+	GrepOn    string               `json:"grepOn,omitempty"` // value, key or any; defaults to value
 	Offset    string               `json:"offset"`
 }
 
+type sourceConfigJSON struct {
+	Type   string  `json:"type"`
+	Path   string  `json:"path,omitempty"`
+	Format string  `json:"format,omitempty"`
+	Speed  float64 `json:"speed,omitempty"`
+	Script string  `json:"script,omitempty"`
+
+	Generator *generatorConfigJSON `json:"generator,omitempty"`
+}
+
+type generatorConfigJSON struct {
+	Rate         float64                   `json:"rate"`
+	FSMIds       int                       `json:"fsmIds"`
+	Distribution string                    `json:"distribution"`
+	ErrorRate    float64                   `json:"errorRate"`
+	Limit        int64                     `json:"limit"`
+	Seed         int64                     `json:"seed"`
+	Flow         []generatorStepConfigJSON `json:"flow"`
+}
+
+type generatorStepConfigJSON struct {
+	Topic  string `json:"topic"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	FanOut int    `json:"fanOut"`
+}
+
+type recordConfigJSON struct {
+	Events bool `json:"events"`
+}
+
 type event struct {
-	EventType  string                   `json:"eventType"`
-	SourceId   string                   `json:"sourceId"`
-	TargetId   string                   `json:"targetId"`
-	Text       string                   `json:"text"`
-	FSMId      string                   `json:"fsmId"`
-	FSMIdAlias string                   `json:"fsmIdAlias"`
-	JSON       []map[string]interface{} `json:"json"`
-	Aggregate  bool                     `json:"aggregate"`
-	Color      string                   `json:"color"`
-	Count      int64                    `json:"count"`
-	NoJSON     bool                     `json:"noJSON,omitempty"`
-	Highlight  bool                     `json:"highlight,omitempty"`
+	EventType   string          `json:"eventType"`
+	SourceId    string          `json:"sourceId"`
+	TargetId    string          `json:"targetId"`
+	Text        string          `json:"text"`
+	FSMId       string          `json:"fsmId"`
+	FSMIdAlias  string          `json:"fsmIdAlias"`
+	JSON        []interface{}   `json:"json,omitempty"`
+	Refs        []messageRef    `json:"refs,omitempty"` // instead of JSON, for messages the UI can fetch
+	Aggregate   bool            `json:"aggregate"`
+	Color       string          `json:"color"`
+	Count       int64           `json:"count"`
+	NoJSON      bool            `json:"noJSON,omitempty"`
+	Highlight   bool            `json:"highlight,omitempty"`
+	Stats       []partitionStat `json:"stats,omitempty"`
+	ComponentId string          `json:"componentId,omitempty"`
+	Lag         []topicLag      `json:"lag,omitempty"`
 }
 
 type pattern struct {
@@ -46,50 +93,161 @@ type rule struct {
 }
 
 type configJSON struct {
-	Rules         []rule `json:"rules"`
-	Kafka         kafka  `json:"kafka"`
-	FSMId         string `json:"fsmId"`
-	HeartbeatUUID string `json:"heartbeatUUID"`
-	Tutorial      bool   `json:"tutorial"`
-	BookieURL     string `json:"bookieURL"`
+	Name          string            `json:"name,omitempty"`
+	Rules         []rule            `json:"rules"`
+	Kafka         kafka             `json:"kafka"`
+	FSMId         string            `json:"fsmId"`
+	HeartbeatUUID string            `json:"heartbeatUUID"`
+	Tutorial      tutorialRef       `json:"tutorial"`
+	BookieURL     string            `json:"bookieURL"`
+	Source        *sourceConfigJSON `json:"source,omitempty"`
+	Record        *recordConfigJSON `json:"record,omitempty"`
+	Components    []componentJSON   `json:"components,omitempty"`
+}
+
+// componentJSON is the part of a diagram component that the server cares
+// about; the rest is only used by the UI.
+type componentJSON struct {
+	Id            string             `json:"id"`
+	ConsumerGroup *consumerGroupJSON `json:"consumerGroup,omitempty"`
+}
+
+type consumerGroupJSON struct {
+	Group  string   `json:"group"`
+	Topics []string `json:"topics"`
 }
 
 type consumerConfig struct {
-	brokers   []string
-	partition int
-	topic     string
-	offset    string
+	brokers    []string
+	partition  int
+	topic      string
+	topicRegex *regexp.Regexp // consume every matching topic instead of topic
+	partitions []int32        // consume only these instead of partition, if set
+	offset     string
+	offsets    map[int32]string   // overrides offset for the given partitions
+	key        *template.Template // if set, sessions for an FSM only consume the partition its key hashes to
+}
+
+// offsetFor returns the configured offset for the partition.
+func (c consumerConfig) offsetFor(partition int32) string {
+	if o, ok := c.offsets[partition]; ok {
+		return o
+	}
+	return c.offset
+}
+
+type sourceConfig struct {
+	kind   string // kafka, tutorial, file, recording or generator
+	path   string
+	format string
+	speed  float64
+	script string
+
+	generator generatorConfig
+}
+
+type generatorConfig struct {
+	rate         float64
+	fsmIds       int
+	distribution string
+	errorRate    float64
+	limit        int64
+	seed         int64
+	flow         []generatorStepConfig
+}
+
+type generatorStepConfig struct {
+	topic  string
+	key    string
+	value  string
+	fanOut int
 }
 
 type config struct {
+	name            string
 	consumers       []consumerConfig
 	brokers         []string
 	fsmId           string
 	bookieCountOnly []string
 	bookieUrl       string
-	tutorial        bool
+	source          sourceConfig
+	record          bool
+	recordEvents    bool
+	componentGroups []componentGroup
+	grep            *grepFilter
+}
+
+// componentGroup is the consumer group of the service a component stands for,
+// whose lag on its topics is shown on the component.
+type componentGroup struct {
+	component string
+	group     string
+	topics    []string
 }
 
 func processConfig(configJSON *configJSON) (*config, error) {
 	config := &config{
+		name:            configJSON.Name,
 		brokers:         strings.Split(configJSON.Kafka.Brokers, ","),
 		fsmId:           configJSON.FSMId,
 		bookieCountOnly: []string{},
 		bookieUrl:       configJSON.BookieURL,
-		tutorial:        configJSON.Tutorial,
+	}
+
+	if configJSON.Record != nil {
+		config.record = true
+		config.recordEvents = configJSON.Record.Events
+	}
+
+	grep, err := newGrepFilter(configJSON.Kafka)
+	if err != nil {
+		return config, err
+	}
+	config.grep = grep
+
+	source, err := processSourceConfig(configJSON)
+	if err != nil {
+		return config, err
+	}
+	config.source = source
+
+	for _, c := range configJSON.Components {
+		if c.ConsumerGroup == nil {
+			continue
+		}
+		if len(c.ConsumerGroup.Group) == 0 || len(c.ConsumerGroup.Topics) == 0 {
+			return config, fmt.Errorf("Please define group and topics for component %v's consumerGroup", c.Id)
+		}
+		config.componentGroups = append(config.componentGroups, componentGroup{component: c.Id, group: c.ConsumerGroup.Group, topics: c.ConsumerGroup.Topics})
 	}
 
 	globalOffset := configJSON.Kafka.Offset
 	for _, consumerJSON := range configJSON.Kafka.Consumers {
 		if consumerJSON.BookieCountOnly {
+			if len(consumerJSON.TopicRegex) > 0 {
+				return config, fmt.Errorf("bookieCountOnly consumers need a topic name rather than a topicRegex %v", consumerJSON)
+			}
 			config.bookieCountOnly = append(config.bookieCountOnly, consumerJSON.Topic)
 			continue
 		}
 
 		consumer := consumerConfig{}
 
-		if len(consumerJSON.Topic) == 0 {
-			return config, fmt.Errorf("Please define topic name for your consumer %v", consumerJSON)
+		if len(consumerJSON.Topic) == 0 && len(consumerJSON.TopicRegex) == 0 {
+			return config, fmt.Errorf("Please define topic name or topicRegex for your consumer %v", consumerJSON)
+		}
+		if len(consumerJSON.Topic) > 0 && len(consumerJSON.TopicRegex) > 0 {
+			return config, fmt.Errorf("Please define either topic name or topicRegex for your consumer %v", consumerJSON)
+		}
+		if len(consumerJSON.TopicRegex) > 0 {
+			if consumerJSON.Partition != nil || len(consumerJSON.Partitions) > 0 || len(consumerJSON.Offsets) > 0 {
+				return config, fmt.Errorf("Partitions can't be set along with topicRegex for your consumer %v", consumerJSON)
+			}
+			re, err := regexp.Compile(consumerJSON.TopicRegex)
+			if err != nil {
+				return config, fmt.Errorf("Invalid topicRegex %v. err=%v", consumerJSON.TopicRegex, err)
+			}
+			consumer.topicRegex = re
 		}
 		consumer.topic = consumerJSON.Topic
 		consumer.brokers = config.brokers
@@ -103,14 +261,223 @@ func processConfig(configJSON *configJSON) (*config, error) {
 		} else {
 			consumer.offset = consumerJSON.Offset
 		}
+		if strings.HasPrefix(consumer.offset, "group:") {
+			if _, _, err := parseGroupOffset(consumer.offset); err != nil {
+				return config, err
+			}
+		}
 
 		if consumerJSON.Partition != nil {
 			consumer.partition = *consumerJSON.Partition
 		} else {
 			consumer.partition = -1
 		}
+
+		if len(consumerJSON.Partitions) > 0 {
+			if consumerJSON.Partition != nil {
+				return config, fmt.Errorf("Please define either partition or partitions for your consumer %v", consumerJSON)
+			}
+			seen := map[int]bool{}
+			for _, p := range consumerJSON.Partitions {
+				if p < 0 || seen[p] {
+					return config, fmt.Errorf("Invalid or repeated partition %v for your consumer on topic %v", p, consumer.topic)
+				}
+				seen[p] = true
+				consumer.partitions = append(consumer.partitions, int32(p))
+			}
+		}
+
+		if len(consumerJSON.KeyTemplate) > 0 {
+			if consumerJSON.Partition != nil || len(consumerJSON.Partitions) > 0 {
+				return config, fmt.Errorf("Please define either partitions or keyTemplate for your consumer %v", consumerJSON)
+			}
+			if consumerJSON.Partitioner != "" && consumerJSON.Partitioner != "hash" {
+				return config, fmt.Errorf("Unsupported partitioner %v for your consumer on topic %v; only hash is", consumerJSON.Partitioner, consumer.topic)
+			}
+			key, err := template.New("key").Parse(consumerJSON.KeyTemplate)
+			if err != nil {
+				return config, fmt.Errorf("Invalid keyTemplate %v. err=%v", consumerJSON.KeyTemplate, err)
+			}
+			consumer.key = key
+		}
+
+		if len(consumerJSON.Offsets) > 0 {
+			offsets, err := processOffsets(consumerJSON.Offsets, consumer)
+			if err != nil {
+				return config, err
+			}
+			consumer.offsets = offsets
+		}
 		config.consumers = append(config.consumers, consumer)
 	}
 
 	return config, nil
 }
+
+// processOffsets validates a consumer's per-partition offsets, which must be
+// for partitions the consumer consumes.
+func processOffsets(offsetsJSON map[string]interface{}, consumer consumerConfig) (map[int32]string, error) {
+	consumes := func(p int32) bool {
+		if consumer.partition != -1 {
+			return int32(consumer.partition) == p
+		}
+		for _, cp := range consumer.partitions {
+			if cp == p {
+				return true
+			}
+		}
+		return len(consumer.partitions) == 0
+	}
+
+	offsets := map[int32]string{}
+	for k, v := range offsetsJSON {
+		p, err := strconv.ParseInt(k, 10, 32)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("Invalid partition %v in offsets for your consumer on topic %v", k, consumer.topic)
+		}
+		if !consumes(int32(p)) {
+			return nil, fmt.Errorf("Offset given for partition %v which your consumer on topic %v doesn't consume", p, consumer.topic)
+		}
+
+		var offset string
+		switch o := v.(type) {
+		case float64:
+			if o != math.Trunc(o) {
+				return nil, fmt.Errorf("Invalid offset %v for partition %v on topic %v", o, p, consumer.topic)
+			}
+			offset = strconv.FormatInt(int64(o), 10)
+		case string:
+			if err := validateOffset(o); err != nil {
+				return nil, fmt.Errorf("Invalid offset %v for partition %v on topic %v. err=%v", o, p, consumer.topic, err)
+			}
+			offset = o
+		default:
+			return nil, fmt.Errorf("Invalid offset %v for partition %v on topic %v", o, p, consumer.topic)
+		}
+		offsets[int32(p)] = offset
+	}
+	return offsets, nil
+}
+
+// validateOffset checks an offset string: oldest, newest, a number, or a
+// consumer group's committed offset.
+func validateOffset(offset string) error {
+	if offset == "oldest" || offset == "newest" {
+		return nil
+	}
+	if strings.HasPrefix(offset, "group:") {
+		_, _, err := parseGroupOffset(offset)
+		return err
+	}
+	if _, err := strconv.ParseInt(offset, 10, 64); err != nil {
+		return fmt.Errorf("Invalid value for consumer offset")
+	}
+	return nil
+}
+
+func processSourceConfig(configJSON *configJSON) (sourceConfig, error) {
+	if configJSON.Source == nil {
+		if configJSON.Tutorial != "" {
+			return sourceConfig{kind: "tutorial", script: string(configJSON.Tutorial)}, nil
+		}
+		return sourceConfig{kind: "kafka"}, nil
+	}
+
+	s := sourceConfig{
+		kind:   configJSON.Source.Type,
+		path:   configJSON.Source.Path,
+		format: configJSON.Source.Format,
+		speed:  configJSON.Source.Speed,
+		script: configJSON.Source.Script,
+	}
+
+	switch s.kind {
+	case "kafka":
+	case "tutorial":
+		if s.script == "" {
+			s.script = "default"
+		}
+	case "file", "recording":
+		if len(s.path) == 0 {
+			return s, fmt.Errorf("Please define a path for your %v source", s.kind)
+		}
+		if s.format == "" {
+			s.format = "jsonl"
+		}
+		if s.format != "jsonl" && s.format != "kcat" {
+			return s, fmt.Errorf("Invalid file source format %v; use jsonl or kcat", s.format)
+		}
+		if s.speed < 0 {
+			return s, fmt.Errorf("Invalid file source speed %v", s.speed)
+		}
+		if s.speed == 0 {
+			s.speed = 1
+		}
+	case "generator":
+		g, err := processGeneratorConfig(configJSON.Source.Generator)
+		if err != nil {
+			return s, err
+		}
+		s.generator = g
+	default:
+		return s, fmt.Errorf("Invalid source type %v; use kafka, tutorial, file, recording or generator", s.kind)
+	}
+
+	return s, nil
+}
+
+func processGeneratorConfig(gJSON *generatorConfigJSON) (generatorConfig, error) {
+	if gJSON == nil || len(gJSON.Flow) == 0 {
+		return generatorConfig{}, fmt.Errorf("Please define at least one flow step for your generator source")
+	}
+
+	g := generatorConfig{
+		rate:         gJSON.Rate,
+		fsmIds:       gJSON.FSMIds,
+		distribution: gJSON.Distribution,
+		errorRate:    gJSON.ErrorRate,
+		limit:        gJSON.Limit,
+		seed:         gJSON.Seed,
+	}
+
+	if g.rate < 0 {
+		return g, fmt.Errorf("Invalid generator rate %v", g.rate)
+	}
+	if g.fsmIds == 0 {
+		g.fsmIds = 100
+	}
+	if g.fsmIds < 1 {
+		return g, fmt.Errorf("Invalid generator fsmIds %v", g.fsmIds)
+	}
+	if g.distribution == "" {
+		g.distribution = "uniform"
+	}
+	if g.distribution != "uniform" && g.distribution != "zipf" {
+		return g, fmt.Errorf("Invalid generator distribution %v; use uniform or zipf", g.distribution)
+	}
+	if g.distribution == "zipf" && g.fsmIds < 2 {
+		return g, fmt.Errorf("A zipf distribution needs at least 2 fsmIds")
+	}
+	if g.errorRate < 0 || g.errorRate > 1 {
+		return g, fmt.Errorf("Invalid generator errorRate %v; should be between 0 and 1", g.errorRate)
+	}
+	if g.seed == 0 {
+		g.seed = time.Now().UnixNano()
+	}
+
+	for _, stepJSON := range gJSON.Flow {
+		if len(stepJSON.Topic) == 0 {
+			return g, fmt.Errorf("Please define topic name for your generator flow step %v", stepJSON)
+		}
+		step := generatorStepConfig{topic: stepJSON.Topic, key: stepJSON.Key, value: stepJSON.Value, fanOut: stepJSON.FanOut}
+		if step.fanOut == 0 {
+			step.fanOut = 1
+		}
+		if step.fanOut < 0 {
+			return g, fmt.Errorf("Invalid fanOut %v for generator flow step on topic %v", step.fanOut, step.topic)
+		}
+		g.flow = append(g.flow, step)
+	}
+
+	return g, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestProcessConfigConsumerPartitionsAndOffsets(t *testing.T) {
+	ts := []struct {
+		name       string
+		consumer   string
+		partitions []int32
+		offsets    map[int32]string
+		fails      bool
+	}{
+		{
+			name:       "per-partition offsets on listed partitions",
+			consumer:   `{"topic": "t", "partitions": [0, 3, 7], "offsets": {"0": 1200, "3": "oldest", "7": "-50"}}`,
+			partitions: []int32{0, 3, 7},
+			offsets:    map[int32]string{0: "1200", 3: "oldest", 7: "-50"},
+		},
+		{
+			name:     "offsets without partitions apply to any partition",
+			consumer: `{"topic": "t", "offsets": {"2": "newest"}}`,
+			offsets:  map[int32]string{2: "newest"},
+		},
+		{
+			name:     "offset for the single partition",
+			consumer: `{"topic": "t", "partition": 1, "offsets": {"1": 5}}`,
+			offsets:  map[int32]string{1: "5"},
+		},
+		{
+			name:     "group offsets",
+			consumer: `{"topic": "t", "offset": "group:svc", "offsets": {"0": "group:svc:-5"}}`,
+			offsets:  map[int32]string{0: "group:svc:-5"},
+		},
+		{name: "group offset without a group", consumer: `{"topic": "t", "offset": "group:"}`, fails: true},
+		{name: "group offset counting forward", consumer: `{"topic": "t", "offsets": {"0": "group:svc:5"}}`, fails: true},
+		{name: "offset for a partition that isn't listed", consumer: `{"topic": "t", "partitions": [0], "offsets": {"1": 5}}`, fails: true},
+		{name: "offset for a partition other than the single one", consumer: `{"topic": "t", "partition": 0, "offsets": {"1": 5}}`, fails: true},
+		{name: "partition and partitions", consumer: `{"topic": "t", "partition": 0, "partitions": [0]}`, fails: true},
+		{name: "repeated partition", consumer: `{"topic": "t", "partitions": [0, 0]}`, fails: true},
+		{name: "negative partition", consumer: `{"topic": "t", "partitions": [-1]}`, fails: true},
+		{name: "invalid partition key", consumer: `{"topic": "t", "offsets": {"a": 5}}`, fails: true},
+		{name: "invalid offset string", consumer: `{"topic": "t", "offsets": {"0": "latest"}}`, fails: true},
+		{name: "fractional offset", consumer: `{"topic": "t", "offsets": {"0": 1.5}}`, fails: true},
+		{name: "keyTemplate with partitions", consumer: `{"topic": "t", "partitions": [0], "keyTemplate": "{{.FSMId}}"}`, fails: true},
+		{name: "unsupported partitioner", consumer: `{"topic": "t", "keyTemplate": "{{.FSMId}}", "partitioner": "random"}`, fails: true},
+		{name: "invalid keyTemplate", consumer: `{"topic": "t", "keyTemplate": "{{.FSMId"}`, fails: true},
+		{name: "partitions with topicRegex", consumer: `{"topicRegex": "t.*", "partitions": [0]}`, fails: true},
+	}
+
+	for _, tc := range ts {
+		var c consumerConfigJson
+		if err := json.Unmarshal([]byte(tc.consumer), &c); err != nil {
+			t.Fatalf("%v: invalid test consumer: %v", tc.name, err)
+		}
+
+		config, err := processConfig(&configJSON{Kafka: kafka{Consumers: []consumerConfigJson{c}}})
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tc.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(config.consumers[0].partitions, tc.partitions) {
+			t.Errorf("%v: expected partitions %v; got %v", tc.name, tc.partitions, config.consumers[0].partitions)
+		}
+		if !reflect.DeepEqual(config.consumers[0].offsets, tc.offsets) {
+			t.Errorf("%v: expected offsets %v; got %v", tc.name, tc.offsets, config.consumers[0].offsets)
+		}
+	}
+}
+
+func TestProcessConfigComponentGroups(t *testing.T) {
+	var c configJSON
+	err := json.Unmarshal([]byte(`{"components": [
+		{"id": "Server", "top": 250, "consumerGroup": {"group": "server", "topics": ["requests"]}},
+		{"id": "Phone"}
+	]}`), &c)
+	if err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+
+	config, err := processConfig(&c)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []componentGroup{{component: "Server", group: "server", topics: []string{"requests"}}}
+	if !reflect.DeepEqual(config.componentGroups, expected) {
+		t.Errorf("expected %v; got %v", expected, config.componentGroups)
+	}
+
+	c.Components[0].ConsumerGroup.Topics = nil
+	if _, err := processConfig(&c); err == nil {
+		t.Error("expected an error for a consumerGroup without topics")
+	}
+}
@@ -2,24 +2,66 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"time"
 
 	"encoding/json"
 
 	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
 	"golang.org/x/net/websocket"
 )
 
 type message struct {
-	Key       string                 `json:"key"`
-	Value     map[string]interface{} `json:"value"`
-	Topic     string                 `json:"topic"`
-	Partition int32                  `json:"partition"`
-	Offset    int64                  `json:"offset"`
-	Timestamp time.Time              `json:"timestamp"` // only set if kafka is version 0.10+
-	Count     int64                  // only for bookie counts
-	FSMId     string                 // only for bookie counts
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"` // usually a JSON object, but may be any JSON value; nil for tombstones
+	IsTombstone bool        `json:"isTombstone,omitempty"`
+	Topic       string      `json:"topic"`
+	Partition   int32       `json:"partition"`
+	Offset      int64       `json:"offset"`
+	Timestamp   time.Time   `json:"timestamp"` // only set if kafka is version 0.10+
+	Count       int64       `json:"-"`         // only for bookie counts; the growth since the last count on this partition
+	FSMId       string      `json:"-"`         // only for bookie counts
+	fetchable   bool        // can be fetched again from Kafka, so events reference it instead of carrying it
+}
+
+// messageRef points at a message on Kafka, for the UI to fetch it on demand
+// from /api/message instead of every event carrying its full JSON.
+type messageRef struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// IsObject tells whether the value is a JSON object, which is what rules
+// usually index into.
+func (m message) IsObject() bool {
+	_, ok := m.Value.(map[string]interface{})
+	return ok
+}
+
+// ValueType is one of object, array, string, number, bool, null or tombstone,
+// for rules to match on.
+func (m message) ValueType() string {
+	if m.IsTombstone {
+		return "tombstone"
+	}
+	return jsonType(m.Value)
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	}
+	return "null"
 }
 
 type iSender interface {
@@ -32,46 +74,62 @@ func (s sender) Send(ws *websocket.Conn, msg string) error {
 	return websocket.Message.Send(ws, msg)
 }
 
-func process(ws *websocket.Conn, c chan *sarama.ConsumerMessage, sender iSender, rules []rule, globalFSMId string, uuid string, bookieCounts map[string]int64) {
+func process(s *session, c chan *sarama.ConsumerMessage, sender iSender, configName string, rules []rule, globalFSMId string, uuid string, grep *grepFilter, fetchable bool, counts chan []message) {
 	ticker := time.NewTicker(time.Millisecond * 100)
 
 	buffer := []message{}
-	for t, c := range bookieCounts {
-		buffer = append(buffer, message{Count: c, Topic: t, FSMId: globalFSMId})
-	}
 
 	fsmIdAliases := map[string]string{}
-	sendSuccess("Starting to send messages!", ws)
+	configName = metricConfig(configName)
+	s.sendSuccess("Starting to send messages!")
 
 	hbCh := make(chan struct{})
-	go processHeartbeats(wsReceiver{ws: ws}, hbCh, uuid, 10*time.Second)
+	go processHeartbeats(s.log, wsReceiver{ws: s.ws}, hbCh, uuid, 10*time.Second)
+
+	buffered := 0
+	defer func() { bufferedMessages.Dec(int64(buffered)) }()
+
+	unparseable := &errorLimiter{every: 5 * time.Second}
 
 	for {
 		select {
-		case cMsg := <-c:
+		case cMsg, ok := <-c:
+			if !ok {
+				c = nil
+				s.sendSuccess("No more messages to consume.")
+				break
+			}
+			countConsumed(cMsg)
+			if !grep.matches(cMsg) {
+				grepFiltered.Inc(1)
+				break
+			}
 			m, err := newMessage(*cMsg)
 			if err != nil {
-				sendError(fmt.Sprintf("Could not parse %v into message", err), ws)
-			}
-			if m.Timestamp.UnixNano() <= 0 {
-				m.Timestamp = time.Now()
+				counter("flowbro_unparseable_messages_total", "topic", cMsg.Topic).Inc(1)
+				if ok, held := unparseable.allow(time.Now()); ok {
+					text := fmt.Sprintf("Skipping message %v/%v/%v as it isn't JSON: %v", cMsg.Topic, cMsg.Partition, cMsg.Offset, err)
+					if held > 0 {
+						text += fmt.Sprintf(" (%v more skipped since the last report)", held)
+					}
+					s.sendError(text)
+				}
+				break
 			}
+			m.fetchable = fetchable
+			m.defaultTimestamp(time.Now())
 			buffer = append(buffer, m)
+		case ms := <-counts:
+			buffer = append(buffer, ms...)
 		case <-ticker.C:
-			events := []event{}
-			incompleteEvents := []event{}
-			for i := 0; len(buffer) > 0 && i < 1000; i++ {
-				err := processMessage(buffer[0], rules, fsmIdAliases, &events, &incompleteEvents, globalFSMId)
-				if err != nil {
-					sendError(fmt.Sprintf("Error while processing message: err=%v", err), ws)
-					break
-				}
-				buffer = buffer[1:]
-			}
-
-			for _, ie := range incompleteEvents {
-				events = aggregate(events, ie, ie.Aggregate, globalFSMId)
+			var events []event
+			var err error
+			events, buffer, err = eventsFrom(buffer, 1000, configName, rules, fsmIdAliases, globalFSMId)
+			if err != nil {
+				s.sendError(fmt.Sprintf("Error while processing message: err=%v", err))
 			}
+			bufferedMessages.Inc(int64(len(buffer) - buffered))
+			buffered = len(buffer)
 
 			if len(events) == 0 {
 				break
@@ -79,36 +137,99 @@ func process(ws *websocket.Conn, c chan *sarama.ConsumerMessage, sender iSender,
 
 			byt, err := json.Marshal(events)
 			if err != nil {
-				sendError(fmt.Sprintf("Error while marshalling events: err=%v\n", err), ws)
+				s.sendError(fmt.Sprintf("Error while marshalling events: err=%v", err))
 				continue
 			}
 
-			err = sender.Send(ws, string(byt))
+			err = sender.Send(s.ws, string(byt))
 			if err != nil {
-				log.Printf("Error while trying to send to WebSocket: err=%v\n", err)
+				sendErrors.Inc(1)
+				s.log.WithFields(log.Fields{"err": err}).Error("Error while trying to send to WebSocket.")
 				return
 			}
+			eventsSent.Inc(int64(len(events)))
 		case <-hbCh:
-			sendError("Timing out due to heartbeat not received.", ws)
+			heartbeatTimeouts.Inc(1)
+			s.sendError("Timing out due to heartbeat not received.")
+			return
+
+		case <-s.closing:
+			s.send(event{EventType: "closing", Text: "Flowbro is shutting down; closing this session.", Color: "error"})
 			return
 		}
 	}
 }
 
-func newMessage(cm sarama.ConsumerMessage) (message, error) {
-	var v interface{}
-	if err := json.Unmarshal(cm.Value, &v); err != nil {
-		return message{}, err
+// eventsFrom runs up to n messages from the head of buffer through the rules
+// and returns the resulting events along with the messages left to process.
+func eventsFrom(buffer []message, n int, configName string, rules []rule, fsmIdAliases map[string]string, globalFSMId string) ([]event, []message, error) {
+	events := []event{}
+	incompleteEvents := []event{}
+
+	var err error
+	for i := 0; len(buffer) > 0 && i < n; i++ {
+		if err = processMessage(buffer[0], configName, rules, fsmIdAliases, &events, &incompleteEvents, globalFSMId); err != nil {
+			break
+		}
+		buffer = buffer[1:]
+	}
+
+	for _, ie := range incompleteEvents {
+		events = aggregate(events, ie, ie.Aggregate, globalFSMId)
 	}
 
-	return message{
+	return events, buffer, err
+}
+
+// defaultTimestamp sets the timestamp of messages that don't have one, e.g.
+// from Kafka before 0.10, to now.
+func (m *message) defaultTimestamp(now time.Time) {
+	if m.Timestamp.UnixNano() <= 0 {
+		m.Timestamp = now
+	}
+}
+
+// errorLimiter lets an error through at most once every so often, counting
+// the ones it held back in between.
+type errorLimiter struct {
+	every time.Duration
+	last  time.Time
+	held  int
+}
+
+// allow tells whether to report an error now and, if so, how many were held
+// back since the last one.
+func (l *errorLimiter) allow(now time.Time) (bool, int) {
+	if now.Sub(l.last) < l.every {
+		l.held++
+		return false, 0
+	}
+
+	held := l.held
+	l.last, l.held = now, 0
+	return true, held
+}
+
+// newMessage decodes a consumed message. A nil value is a tombstone, i.e. a
+// deletion on a compacted topic.
+func newMessage(cm sarama.ConsumerMessage) (message, error) {
+	m := message{
 		Key:       string(cm.Key),
-		Value:     v.(map[string]interface{}),
 		Topic:     cm.Topic,
 		Partition: cm.Partition,
 		Offset:    cm.Offset,
 		Timestamp: cm.Timestamp,
-	}, nil
+	}
+
+	if cm.Value == nil {
+		m.IsTombstone = true
+		return m, nil
+	}
+
+	if err := json.Unmarshal(cm.Value, &m.Value); err != nil {
+		return message{}, err
+	}
+	return m, nil
 }
 
 func sliceInsert(slice []message, index int, value message) []message {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestNewMessage(t *testing.T) {
+	ts := []struct {
+		name      string
+		value     []byte
+		expected  interface{}
+		valueType string
+		fails     bool
+	}{
+		{name: "object", value: []byte(`{"a":1}`), expected: map[string]interface{}{"a": 1.0}, valueType: "object"},
+		{name: "array", value: []byte(`[1,"b"]`), expected: []interface{}{1.0, "b"}, valueType: "array"},
+		{name: "string", value: []byte(`"hi"`), expected: "hi", valueType: "string"},
+		{name: "number", value: []byte(`42`), expected: 42.0, valueType: "number"},
+		{name: "null", value: []byte(`null`), expected: nil, valueType: "null"},
+		{name: "tombstone", value: nil, expected: nil, valueType: "tombstone"},
+		{name: "not json", value: []byte(`{"a":`), fails: true},
+	}
+
+	for _, tc := range ts {
+		m, err := newMessage(sarama.ConsumerMessage{Key: []byte("k"), Value: tc.value, Topic: "t", Offset: 3})
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tc.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(m.Value, tc.expected) {
+			t.Errorf("%v: expected value %#v; got %#v", tc.name, tc.expected, m.Value)
+		}
+		if m.ValueType() != tc.valueType {
+			t.Errorf("%v: expected value type %v; got %v", tc.name, tc.valueType, m.ValueType())
+		}
+		if m.IsTombstone != (tc.valueType == "tombstone") {
+			t.Errorf("%v: expected IsTombstone to be %v", tc.name, !m.IsTombstone)
+		}
+		if m.Key != "k" || m.Topic != "t" || m.Offset != 3 {
+			t.Errorf("%v: expected key, topic and offset to be kept; got %+v", tc.name, m)
+		}
+	}
+}
+
+func TestErrorLimiter(t *testing.T) {
+	l := &errorLimiter{every: time.Second}
+	now := time.Now()
+
+	if ok, _ := l.allow(now); !ok {
+		t.Error("expected the first error through")
+	}
+	if ok, _ := l.allow(now.Add(100 * time.Millisecond)); ok {
+		t.Error("expected an error right after the first to be held back")
+	}
+	l.allow(now.Add(200 * time.Millisecond))
+
+	ok, held := l.allow(now.Add(time.Second))
+	if !ok || held != 2 {
+		t.Errorf("expected an error through after a second, with 2 held back; got %v, %v", ok, held)
+	}
+}
@@ -3,14 +3,20 @@ package main
 import (
 	"bytes"
 	"regexp"
+	"strconv"
 	"text/template"
 )
 
-func processMessage(m message, rules []rule, fsmIdAliases map[string]string, events *[]event, incompleteEvents *[]event, globalFSMId string) error {
-	for _, r := range rules {
+func processMessage(m message, configName string, rules []rule, fsmIdAliases map[string]string, events *[]event, incompleteEvents *[]event, globalFSMId string) error {
+	for i, r := range rules {
 		pass := true
 		for _, p := range r.Patterns {
 			b, err := parseTempl(p.Field, m)
+			if err != nil && !m.IsObject() {
+				// e.g. indexing into a tombstone; the rule is for other messages
+				pass = false
+				break
+			}
 			if err != nil {
 				return err
 			}
@@ -28,6 +34,8 @@ func processMessage(m message, rules []rule, fsmIdAliases map[string]string, eve
 		if !pass {
 			continue
 		}
+		counter("flowbro_rule_matches_total", "config", configName, "rule", strconv.Itoa(i)).Inc(1)
+
 		for _, e := range r.Events {
 			bEventType, err := parseTempl(e.EventType, m)
 			if err != nil {
@@ -79,9 +87,16 @@ func processMessage(m message, rules []rule, fsmIdAliases map[string]string, eve
 				}
 			}
 
-			json := []map[string]interface{}{}
-			if !e.NoJSON {
-				json = []map[string]interface{}{m.Value}
+			json, refs := []interface{}{}, []messageRef(nil)
+			if !e.NoJSON && m.fetchable {
+				json, refs = nil, []messageRef{{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset}}
+			} else if !e.NoJSON {
+				json = []interface{}{m.Value}
+			}
+
+			count := int64(1)
+			if m.Count > 0 {
+				count = m.Count
 			}
 
 			if len(fsmId) == 0 && len(fsmIdAlias) > 0 {
@@ -92,6 +107,8 @@ func processMessage(m message, rules []rule, fsmIdAliases map[string]string, eve
 					TargetId:   string(bTargetId),
 					Text:       string(bText),
 					JSON:       json,
+					Refs:       refs,
+					Count:      count,
 					Aggregate:  e.Aggregate,
 					Highlight:  e.Highlight,
 				})
@@ -102,11 +119,6 @@ func processMessage(m message, rules []rule, fsmIdAliases map[string]string, eve
 				continue
 			}
 
-			count := int64(1)
-			if m.Count > 0 {
-				count = m.Count
-			}
-
 			newE := event{
 				EventType: string(bEventType),
 				FSMId:     fsmId,
@@ -114,6 +126,7 @@ func processMessage(m message, rules []rule, fsmIdAliases map[string]string, eve
 				TargetId:  string(bTargetId),
 				Text:      string(bText),
 				JSON:      json,
+				Refs:      refs,
 				Count:     count,
 				Aggregate: e.Aggregate,
 				Highlight: e.Highlight,
@@ -150,8 +163,9 @@ func aggregate(events []event, e event, aggregate bool, globalFSMId string) []ev
 	for i, ev := range events {
 		if ev.FSMId == e.FSMId && ev.SourceId == e.SourceId && ev.TargetId == e.TargetId {
 			events[i].Highlight = events[i].Highlight || e.Highlight
-			events[i].Count++
+			events[i].Count += e.Count
 			events[i].JSON = append(events[i].JSON, e.JSON...)
+			events[i].Refs = append(events[i].Refs, e.Refs...)
 			return events
 		}
 	}
@@ -323,7 +323,79 @@ func TestProcessMessage(t *testing.T) {
 			},
 			fa: map[string]string{},
 			expectedEvents: []event{
-				{EventType: "message", SourceId: "A", TargetId: "B", Text: "Hi, B!", FSMId: "456", JSON: []map[string]interface{}{}, Aggregate: true, Count: 2},
+				{EventType: "message", SourceId: "A", TargetId: "B", Text: "Hi, B!", FSMId: "456", JSON: []interface{}{}, Aggregate: true, Count: 2},
+			},
+			expectedFa: map[string]string{},
+		},
+		{
+			name: "aggregating bookie counts",
+			m: message{
+				Topic:     "audit",
+				Partition: 3,
+				Count:     5,
+				FSMId:     "456",
+			},
+			rs: []rule{
+				{
+					Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "audit"}},
+					Events: []event{
+						{EventType: "message", SourceId: "A", TargetId: "B", Text: "Audited", Aggregate: true, NoJSON: true},
+						{EventType: "message", SourceId: "A", TargetId: "B", Text: "Audited again", Aggregate: true, NoJSON: true},
+					},
+				},
+			},
+			fa: map[string]string{},
+			expectedEvents: []event{
+				{EventType: "message", SourceId: "A", TargetId: "B", Text: "Audited", FSMId: "456", JSON: []interface{}{}, Aggregate: true, Count: 10},
+			},
+			expectedFa: map[string]string{},
+		},
+		{
+			name: "matching a tombstone without failing rules that index into values",
+			m:    message{Key: "456", Topic: "orders", IsTombstone: true},
+			rs: []rule{
+				{
+					Patterns: []pattern{{Field: `{{index .Value "id"}}`, Pattern: `\d+`}},
+					Events:   []event{{EventType: "message", SourceId: "A", TargetId: "B", Text: "Created", FSMId: "{{.Key}}"}},
+				},
+				{
+					Patterns: []pattern{{Field: "{{.ValueType}}", Pattern: "^tombstone$"}},
+					Events:   []event{{EventType: "message", SourceId: "A", TargetId: "B", Text: "Deleted", FSMId: "{{.Key}}"}},
+				},
+			},
+			fa: map[string]string{},
+			expectedEvents: []event{
+				{EventType: "message", SourceId: "A", TargetId: "B", Text: "Deleted", FSMId: "456", JSON: []interface{}{nil}, Count: 1},
+			},
+			expectedFa: map[string]string{},
+		},
+		{
+			name: "matching an array value",
+			m:    message{Key: "456", Topic: "batches", Value: []interface{}{"first", "second"}},
+			rs: []rule{
+				{
+					Patterns: []pattern{{Field: "{{.ValueType}}", Pattern: "^array$"}},
+					Events:   []event{{EventType: "message", SourceId: "A", TargetId: "B", Text: `{{index .Value 0}}`, FSMId: "{{.Key}}"}},
+				},
+			},
+			fa: map[string]string{},
+			expectedEvents: []event{
+				{EventType: "message", SourceId: "A", TargetId: "B", Text: "first", FSMId: "456", JSON: []interface{}{[]interface{}{"first", "second"}}, Count: 1},
+			},
+			expectedFa: map[string]string{},
+		},
+		{
+			name: "referencing messages that can be fetched from Kafka instead of carrying them",
+			m:    message{Key: "456", Value: newValueFrom(`{"big":"payload"}`), Topic: "orders", Partition: 2, Offset: 99, fetchable: true},
+			rs: []rule{
+				{
+					Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "orders"}},
+					Events:   []event{{EventType: "message", SourceId: "A", TargetId: "B", Text: "Hi!", FSMId: "{{.Key}}"}},
+				},
+			},
+			fa: map[string]string{},
+			expectedEvents: []event{
+				{EventType: "message", SourceId: "A", TargetId: "B", Text: "Hi!", FSMId: "456", Refs: []messageRef{{Topic: "orders", Partition: 2, Offset: 99}}, Count: 1},
 			},
 			expectedFa: map[string]string{},
 		},
@@ -331,7 +403,7 @@ func TestProcessMessage(t *testing.T) {
 
 	for _, ts := range tests {
 		actualEvents := []event{}
-		err := processMessage(ts.m, ts.rs, ts.fa, &actualEvents, &ts.ie, ts.globalFSMId)
+		err := processMessage(ts.m, "", ts.rs, ts.fa, &actualEvents, &ts.ie, ts.globalFSMId)
 
 		if err != nil {
 			t.Errorf("'%v' shouldn't have failed, but did with %v", ts.name, err)
@@ -348,12 +420,73 @@ func TestProcessMessage(t *testing.T) {
 	}
 }
 
+func TestEventsFromAggregatesIncompleteEvents(t *testing.T) {
+	rules := []rule{
+		{
+			Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "topic"}},
+			Events:   []event{{EventType: "message", SourceId: "A", TargetId: "B", Text: "Hi!", FSMIdAlias: "{{.Key}}", Aggregate: true}},
+		},
+	}
+	buffer := []message{
+		{Key: "789", Value: newValueFrom(`{"n":1}`), Topic: "topic"},
+		{Key: "789", Value: newValueFrom(`{"n":2}`), Topic: "topic"},
+		{Key: "789", Value: newValueFrom(`{"n":3}`), Topic: "topic", Count: 2},
+	}
+
+	events, rest, err := eventsFrom(buffer, len(buffer), "", rules, map[string]string{}, "")
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("expected every message to be processed; %v left", len(rest))
+	}
+
+	expected := []event{{
+		EventType:  "message",
+		FSMIdAlias: "789",
+		SourceId:   "A",
+		TargetId:   "B",
+		Text:       "Hi!",
+		JSON:       []interface{}{newValueFrom(`{"n":1}`), newValueFrom(`{"n":2}`), newValueFrom(`{"n":3}`)},
+		Count:      4,
+		Aggregate:  true,
+	}}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v; got %+v", expected, events)
+	}
+}
+
+func TestReferencingEventsDontSendJSON(t *testing.T) {
+	rules := []rule{
+		{
+			Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "orders"}},
+			Events:   []event{{EventType: "message", SourceId: "A", TargetId: "B", FSMId: "{{.Key}}"}},
+		},
+	}
+	buffer := []message{{Key: "456", Value: newValueFrom(`{"big":"payload"}`), Topic: "orders", Offset: 99, fetchable: true}}
+
+	events, _, err := eventsFrom(buffer, len(buffer), "", rules, map[string]string{}, "")
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	byt, err := json.Marshal(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []map[string]interface{}
+	json.Unmarshal(byt, &actual)
+	if _, ok := actual[0]["json"]; ok || actual[0]["refs"] == nil {
+		t.Errorf("expected refs instead of json; got %s", byt)
+	}
+}
+
 func newValueFrom(j string) map[string]interface{} {
 	var v interface{}
 	json.Unmarshal([]byte(j), &v)
 	return v.(map[string]interface{})
 }
 
-func newSliceFrom(j string) []map[string]interface{} {
-	return []map[string]interface{}{newValueFrom(j)}
+func newSliceFrom(j string) []interface{} {
+	return []interface{}{newValueFrom(j)}
 }
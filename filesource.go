@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+var replayDir = flag.String("replay-dir", "replays", "directory that file sources are allowed to read from")
+
+// kcatMessage is a line of `kcat -C -J` output.
+type kcatMessage struct {
+	Topic     string  `json:"topic"`
+	Partition int32   `json:"partition"`
+	Offset    int64   `json:"offset"`
+	TsType    string  `json:"tstype"`
+	Ts        int64   `json:"ts"`
+	Key       *string `json:"key"`
+	Payload   *string `json:"payload"`
+}
+
+func (km kcatMessage) consumerMessage() *sarama.ConsumerMessage {
+	cm := &sarama.ConsumerMessage{
+		Topic:     km.Topic,
+		Partition: km.Partition,
+		Offset:    km.Offset,
+	}
+	if km.Key != nil {
+		cm.Key = []byte(*km.Key)
+	}
+	if km.Payload != nil {
+		cm.Value = []byte(*km.Payload)
+	}
+	if km.Ts > 0 {
+		cm.Timestamp = time.Unix(0, km.Ts*int64(time.Millisecond))
+	}
+	return cm
+}
+
+func readKcatMessages(r io.Reader) ([]*sarama.ConsumerMessage, error) {
+	cms := []*sarama.ConsumerMessage{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var km kcatMessage
+		if err := json.Unmarshal(scanner.Bytes(), &km); err != nil {
+			return cms, fmt.Errorf("Could not parse line %v. err=%v", line, err)
+		}
+		cms = append(cms, km.consumerMessage())
+	}
+
+	return cms, scanner.Err()
+}
+
+type fileSource struct {
+	cms   []*sarama.ConsumerMessage
+	speed float64
+	c     chan *sarama.ConsumerMessage
+	done  chan struct{}
+}
+
+func newFileSource(conf sourceConfig, logger *log.Entry) (*fileSource, error) {
+	base, path := *replayDir, conf.path
+	if conf.kind == "recording" {
+		base, path = *recordingsDir, conf.path+recordingExt
+	}
+
+	path, err := resolvePath(base, path)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := replayFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cms := []*sarama.ConsumerMessage{}
+	for _, file := range files {
+		fcms, err := readMessagesFile(file, conf.format)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %v. err=%v", filepath.Base(file), err)
+		}
+		cms = append(cms, fcms...)
+	}
+	sortByTimestamp(cms)
+
+	s := &fileSource{
+		cms:   cms,
+		speed: conf.speed,
+		c:     make(chan *sarama.ConsumerMessage),
+		done:  make(chan struct{}),
+	}
+	go s.replay()
+
+	logger.WithFields(log.Fields{"path": path, "files": len(files), "messages": len(cms), "speed": conf.speed}).Info("Replaying messages from file source.")
+	return s, nil
+}
+
+func (s *fileSource) messages() chan *sarama.ConsumerMessage { return s.c }
+func (s *fileSource) close()                                 { close(s.done) }
+
+// replay pushes the messages keeping the original gaps between timestamps,
+// shortened or stretched by the speed multiplier.
+func (s *fileSource) replay() {
+	var last time.Time
+	for _, cm := range s.cms {
+		if !cm.Timestamp.IsZero() {
+			if !last.IsZero() && cm.Timestamp.After(last) {
+				select {
+				case <-time.After(time.Duration(float64(cm.Timestamp.Sub(last)) / s.speed)):
+				case <-s.done:
+					return
+				}
+			}
+			last = cm.Timestamp
+		}
+
+		select {
+		case s.c <- cm:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// resolvePath makes path relative to the base directory, refusing anything
+// that would escape it; configs come from the browser.
+func resolvePath(base string, path string) (string, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := filepath.Join(base, filepath.Clean("/"+path))
+	if resolved != base && !strings.HasPrefix(resolved, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path %v is outside of %v", path, base)
+	}
+	return resolved, nil
+}
+
+func replayFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			files = append(files, filepath.Join(path, info.Name()))
+		}
+	}
+	return files, nil
+}
+
+func readMessagesFile(path string, format string) ([]*sarama.ConsumerMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(path, recordingExt) {
+		return readArchivedMessages(f)
+	}
+	if format == "kcat" {
+		return readKcatMessages(f)
+	}
+	return readRecordedMessages(f)
+}
+
+// sortByTimestamp orders messages by timestamp. If any message lacks one,
+// the original order is kept as there's nothing sensible to sort by.
+func sortByTimestamp(cms []*sarama.ConsumerMessage) {
+	for _, cm := range cms {
+		if cm.Timestamp.IsZero() {
+			return
+		}
+	}
+	sort.SliceStable(cms, func(i, j int) bool { return cms[i].Timestamp.Before(cms[j].Timestamp) })
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestReadKcatMessages(t *testing.T) {
+	input := `{"topic":"requests","partition":1,"offset":5,"tstype":"create","ts":1484000000000,"broker":1,"key":"k","payload":"{\"target\":\"phone\"}"}
+{"topic":"requests","partition":1,"offset":6,"tstype":"create","ts":1484000000500,"broker":1,"key":null,"payload":null}
+`
+	cms, err := readKcatMessages(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(cms) != 2 {
+		t.Fatalf("expected 2 messages but got %v", len(cms))
+	}
+	if string(cms[0].Key) != "k" || string(cms[0].Value) != `{"target":"phone"}` || cms[0].Offset != 5 || !cms[0].Timestamp.Equal(time.Unix(1484000000, 0)) {
+		t.Errorf("first message mismatch; got %+v", cms[0])
+	}
+	if cms[1].Key != nil || cms[1].Value != nil {
+		t.Errorf("expected null key and payload to stay nil; got %+v", cms[1])
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "incident", expected: "/var/replays/incident"},
+		{path: "a/b.jsonl", expected: "/var/replays/a/b.jsonl"},
+		{path: "../../etc/passwd", expected: "/var/replays/etc/passwd"},
+		{path: "/etc/passwd", expected: "/var/replays/etc/passwd"},
+	}
+
+	for _, ts := range tests {
+		actual, err := resolvePath("/var/replays", ts.path)
+		if err != nil {
+			t.Errorf("'%v' shouldn't have failed, but did with %v", ts.path, err)
+		}
+		if actual != ts.expected {
+			t.Errorf("on '%v': expected %v but got %v", ts.path, ts.expected, actual)
+		}
+	}
+}
+
+func TestFileSourceReplaysInTimestampOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowbro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	*replayDir = dir
+	defer func() { *replayDir = "replays" }()
+
+	os.Mkdir(filepath.Join(dir, "session"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "session", "a.jsonl"), []byte(`{"key":"1","value":{},"topic":"a","timestamp":"2017-01-01T00:00:00Z"}
+{"key":"3","value":{},"topic":"a","timestamp":"2017-01-01T00:00:02Z"}
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "session", "b.jsonl"), []byte(`{"key":"2","value":{},"topic":"b","timestamp":"2017-01-01T00:00:01Z"}
+`), 0644)
+
+	s, err := newFileSource(sourceConfig{kind: "file", path: "session", format: "jsonl", speed: 1000}, log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	defer s.close()
+
+	for _, expected := range []string{"1", "2", "3"} {
+		select {
+		case cm := <-s.messages():
+			if string(cm.Key) != expected {
+				t.Errorf("expected key %v but got %v", expected, string(cm.Key))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for key %v", expected)
+		}
+	}
+}
@@ -1,124 +1,181 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"html/template"
-	"net"
 	"net/http"
+	"sync"
+	"time"
 
-	"github.com/Shopify/sarama"
 	log "github.com/Sirupsen/logrus"
 	"golang.org/x/net/websocket"
 )
 
-type flowbro struct{}
+type flowbro struct {
+	index *indexer
+
+	l        sync.Mutex
+	sessions map[string]*session
+	closing  bool
+	wg       sync.WaitGroup
+}
 
 func (f *flowbro) onConnected() func(ws *websocket.Conn) {
 	return func(ws *websocket.Conn) {
-		log.Println("Opened WebSocket connection!")
+		s := newSession(ws)
+		if !f.register(s) {
+			s.log.Info("Refusing WebSocket connection while shutting down.")
+			ws.Close()
+			return
+		}
+		defer f.unregister(s)
+
+		s.log.Info("Opened WebSocket connection.")
+		activeSessions.Inc(1)
+		defer activeSessions.Dec(1)
 
 		var configJSON configJSON
 		err := websocket.JSON.Receive(ws, &configJSON)
 		if err != nil {
 			ws.Close()
-			log.Println("Didn't receive config from WebSocket!", err)
+			s.log.WithFields(log.Fields{"err": err}).Warn("Didn't receive config from WebSocket.")
 			return
 		}
+		s.log = s.log.WithFields(log.Fields{"config": configJSON.Name})
 
 		config, err := processConfig(&configJSON)
 		if err != nil {
-			sendError(fmt.Sprintf("Closing WebSocket connection due to: %v\n", err), ws)
+			s.sendError(fmt.Sprintf("Closing WebSocket connection due to: %v", err))
 			ws.Close()
 			return
 		}
 
-		c, bookieCounts, cluster, ok := setupKafka(ws, config)
+		src, counts, ok := setupSource(s, config)
 		if !ok {
 			return
 		}
 
-		process(ws, c, sender{}, configJSON.Rules, configJSON.FSMId, configJSON.HeartbeatUUID, bookieCounts)
-
-		if !config.tutorial {
-			cluster.close()
+		c, snd := src.messages(), iSender(sender{})
+		if config.record {
+			rec, err := newRecorder(*recordingsDir, configJSON, config.recordEvents, s.log)
+			if err != nil {
+				s.sendError(fmt.Sprintf("Could not start recording this session: %v", err))
+			} else {
+				c, snd = rec.tee(c), recordingSender{iSender: snd, r: rec}
+				s.sendSuccess(fmt.Sprintf("Recording this session; download it from /recordings/%v%v once it's over.", rec.id, recordingExt))
+				defer func() {
+					if err := rec.close(); err != nil {
+						s.log.WithFields(log.Fields{"err": err, "recording": rec.id}).Error("Could not save recording.")
+					}
+				}()
+			}
 		}
+
+		process(s, c, snd, configJSON.Name, configJSON.Rules, configJSON.FSMId, configJSON.HeartbeatUUID, config.grep, config.source.kind == "kafka", counts)
+
+		src.close()
 		ws.Close()
+		s.log.Info("Closed WebSocket connection.")
+	}
+}
+
+func setupSource(s *session, config *config) (source, chan []message, bool) {
+	switch config.source.kind {
+	case "tutorial":
+		script, err := loadTutorialScript(config.source.script)
+		if err != nil {
+			s.sendError(fmt.Sprintf("Closing WebSocket connection due to errors while loading tutorial: %v", err))
+			s.ws.Close()
+			return nil, nil, false
+		}
+		s.sendSuccess("Starting tutorial. Flowbro is not really connected to a Kafka broker; messages are being mocked.")
+		return newTutorialSource(script), nil, true
+	case "file", "recording":
+		fs, err := newFileSource(config.source, s.log)
+		if err != nil {
+			s.sendError(fmt.Sprintf("Closing WebSocket connection due to errors while setting up %v source: %v", config.source.kind, err))
+			s.ws.Close()
+			return nil, nil, false
+		}
+		s.sendSuccess(fmt.Sprintf("Replaying %v messages from %v. Flowbro is not really connected to a Kafka broker.", len(fs.cms), config.source.path))
+		return fs, nil, true
+	case "generator":
+		gs, err := newGeneratorSource(config.source.generator, s.log)
+		if err != nil {
+			s.sendError(fmt.Sprintf("Closing WebSocket connection due to errors while setting up generator source: %v", err))
+			s.ws.Close()
+			return nil, nil, false
+		}
+		s.sendSuccess("Generating synthetic messages. Flowbro is not really connected to a Kafka broker.")
+		return gs, nil, true
 	}
+
+	return setupKafka(s, config)
 }
 
-func setupKafka(ws *websocket.Conn, config *config) (chan *sarama.ConsumerMessage, map[string]int64, *cluster, bool) {
-	bookieCounts := map[string]int64{}
+func setupKafka(s *session, config *config) (source, chan []message, bool) {
 	bookie, f := bookie{}, fsm{}
 	var err error
 	if config.bookieUrl != "" {
-		bookie = newBookie(config.bookieUrl)
+		bookie = newBookie(config.bookieUrl, s.log)
 		f, err = bookie.fsm(config.fsmId)
 		if len(config.fsmId) > 0 && err != nil {
-			log.WithFields(log.Fields{"err": err, "fsmId": config.fsmId, "url": bookie.url}).Warn("Failed to fetch FSMId from Bookie.")
+			s.log.WithFields(log.Fields{"err": err, "fsmId": config.fsmId, "url": bookie.url}).Warn("Failed to fetch FSMId from Bookie.")
 		}
 	}
 
-	if config.tutorial {
-		sendSuccess("Starting tutorial. Flowbro is not really connected to a Kafka broker; messages are being mocked.", ws)
-		return tutorial(), bookieCounts, &cluster{}, true
-	}
-
-	cluster := setupCluster(config, f)
+	cluster := setupCluster(config, f, s.id, s.log, func(err error) {
+		s.sendError(fmt.Sprintf("Error while consuming from Kafka: %v", err))
+	})
 	if len(cluster.es.errors) > 0 {
-		sendError(fmt.Sprintf("Closing WebSocket connection due to errors while setting up partition consumers: %v", cluster.es.errors), ws)
+		s.sendError(fmt.Sprintf("Closing WebSocket connection due to errors while setting up partition consumers: %v", cluster.es.errors))
 		cluster.close()
-		ws.Close()
-		return nil, bookieCounts, nil, false
+		s.ws.Close()
+		return nil, nil, false
 	}
 
-	c := joinMessages(cluster.chs)
+	cluster.follow(*metadataRefresh, s.sendSuccess)
+	src := newKafkaSource(cluster)
+	go reportStats(s, cluster, *statsInterval, src.stop)
+	go reportComponentStatus(s, cluster.client, config.componentGroups, *componentStatusInterval, src.stop)
+	if len(config.fsmId) > 0 {
+		go reportReplayProgress(s, cluster, config.fsmId, 2*time.Second, src.stop)
+	}
 
-	for _, t := range config.bookieCountOnly {
-		if len(config.fsmId) == 0 {
-			sendError(fmt.Sprintf("Note that, since fsmId is not set, you won't see any events coming from topic %v", t), ws)
-			continue
-		}
+	if len(config.bookieCountOnly) == 0 {
+		return src, nil, true
+	}
 
-		if ti, ok := f.Topics[t]; ok {
-			bookieCounts[t] = ti.Count
-			continue
+	if len(config.fsmId) == 0 {
+		for _, t := range config.bookieCountOnly {
+			s.sendError(fmt.Sprintf("Note that, since fsmId is not set, you won't see any events coming from topic %v", t))
 		}
-		sendError(fmt.Sprintf("Didn't find message count for topic %v for fsmID %v on Bookie", t, f.Id), ws)
+		return src, nil, true
 	}
 
-	return c, bookieCounts, &cluster, true
-}
-
-func sendError(error string, ws *websocket.Conn) {
-	log.Printf(error)
-
-	byt, err := json.Marshal([]event{{EventType: "log", Text: error, Color: "error"}})
-	if err != nil {
-		log.Printf("Error while marshalling error: err=%v\n", err)
-		return
+	for _, t := range config.bookieCountOnly {
+		if _, ok := f.Topics[t]; !ok {
+			s.sendError(fmt.Sprintf("Didn't find message count for topic %v for fsmID %v on Bookie yet; will keep polling", t, config.fsmId))
+		}
 	}
 
-	websocket.Message.Send(ws, string(byt))
-}
-
-func sendSuccess(text string, ws *websocket.Conn) {
-	log.Printf(text)
-
-	byt, err := json.Marshal([]event{{EventType: "log", Text: text, Color: "happy"}})
-	if err != nil {
-		log.Printf("Error while marshalling error: err=%v\n", err)
-		return
+	if config.bookieUrl == "" {
+		return src, nil, true
 	}
 
-	websocket.Message.Send(ws, string(byt))
+	counts := make(chan []message)
+	go pollBookieCounts(s.log, bookie, newBookieCounter(config.fsmId, config.bookieCountOnly), f, *bookieCountInterval, counts, src.stop)
+
+	return src, counts, true
 }
 
 func (f *flowbro) baseHandler(template *template.Template) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" && r.URL.RawQuery == "" {
+		if r.URL.Path == "/" && r.URL.RawQuery == "" && template == nil {
+			http.Error(w, "Base page template didn't parse; see /healthz", http.StatusInternalServerError)
+		} else if r.URL.Path == "/" && r.URL.RawQuery == "" {
 			if err := serveBaseHTML(template, w, r); err != nil {
-				log.Printf("Loading base page failed; ignoring. err=%v\n", err)
+				log.WithFields(log.Fields{"err": err}).Warn("Loading base page failed; ignoring.")
 			}
 		} else {
 			http.FileServer(http.Dir("webroot")).ServeHTTP(w, r)
@@ -126,13 +183,22 @@ func (f *flowbro) baseHandler(template *template.Template) func(http.ResponseWri
 	}
 }
 
-func serve(f *flowbro, baseTemplate *template.Template, listener *net.TCPListener) {
+// server serves flowbro; without a base template, i.e. if it didn't parse, the
+// landing page fails and /healthz reports templateErr.
+func (f *flowbro) server(baseTemplate *template.Template, templateErr error) *http.Server {
 	mux := http.NewServeMux()
 	mux.Handle("/ws", websocket.Handler(f.onConnected()))
+	mux.HandleFunc("/recordings/", recordingsHandler(*recordingsDir))
+	mux.HandleFunc("/api/fsms", searchHandler)
+	mux.HandleFunc("/api/peek", peekHandler)
+	mux.HandleFunc("/api/message", messageHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler(mainPath, templateErr))
+	mux.HandleFunc("/readyz", readyzHandler(mainPath, templateErr, *readyzCheckDeps))
+	if f.index != nil {
+		mux.HandleFunc("/index/", f.index.handler("/index"))
+	}
 	mux.HandleFunc("/", f.baseHandler(baseTemplate))
 
-	err := http.Serve(listener, mux)
-	if err != nil {
-		log.Println("Flowbro server went down: ", err)
-	}
+	return &http.Server{Handler: mux}
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+var metadataRefresh = flag.Duration("metadata-refresh", 30*time.Second, "how often sessions refresh Kafka metadata to pick up new partitions and topics matching topicRegex; 0 disables it")
+
+// follow refreshes the cluster's metadata every so often, until the cluster is
+// closed, and starts consuming the partitions and regex-matched topics that
+// appeared since, from their oldest offset. notice is told about each one.
+// Must be called before joining the cluster's messages.
+func (c *cluster) follow(every time.Duration, notice func(string)) {
+	c.chsLock.Lock()
+	followed := c.followed
+	c.chsLock.Unlock()
+	if every <= 0 || len(followed) == 0 || c.client == nil {
+		return
+	}
+
+	more := make(chan (<-chan *sarama.ConsumerMessage))
+	c.more = more
+
+	go func() {
+		defer close(more)
+
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.closed:
+				return
+			}
+
+			if err := c.client.RefreshMetadata(); err != nil {
+				c.log.WithFields(log.Fields{"err": err}).Warn("Could not refresh metadata.")
+				continue
+			}
+
+			for _, conf := range followed {
+				for _, ch := range c.addNewPartitions(conf, notice) {
+					select {
+					case more <- ch:
+					case <-c.closed:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// addNewPartitions starts consuming the consumer's partitions that aren't
+// being consumed yet, returning their channels.
+func (c *cluster) addNewPartitions(conf consumerConfig, notice func(string)) []<-chan *sarama.ConsumerMessage {
+	topics, err := resolveTopics(conf, c.client)
+	if err != nil {
+		c.log.WithFields(log.Fields{"err": err}).Warn("Could not resolve topics.")
+		return nil
+	}
+
+	chs := []<-chan *sarama.ConsumerMessage{}
+	for _, topic := range topics {
+		partitions, err := c.consumer.Partitions(topic)
+		if err != nil {
+			c.log.WithFields(log.Fields{"err": err, "topic": topic}).Warn("Could not fetch partitions.")
+			continue
+		}
+
+		for _, partition := range partitions {
+			if !c.markConsuming(topic, partition) {
+				continue
+			}
+
+			pc, err := c.consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				c.unmarkConsuming(topic, partition) // retried on the next refresh
+				c.reportError(fmt.Errorf("Could not start consuming new partition %v of topic %v. err=%v", partition, topic, err))
+				continue
+			}
+			if !c.addPartitionConsumer(pc) {
+				pc.Close()
+				return chs
+			}
+
+			ps := c.track(pc, topic, partition, sarama.OffsetOldest)
+			chs = append(chs, c.consume(pc, ps, nil))
+			c.log.WithFields(log.Fields{"topic": topic, "partition": partition}).Info("Consuming new partition.")
+			notice(fmt.Sprintf("Started consuming new partition %v of topic %v.", partition, topic))
+		}
+	}
+	return chs
+}
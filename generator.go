@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+// generatorSource synthesises messages from templates, for demos and for
+// load testing the pipeline without a Kafka cluster.
+//
+// Every flow picks an FSM id and emits one message per step, fanning out into
+// several messages per step if configured. Flows start at the configured
+// rate; a rate of 0 means as fast as the session can consume them.
+type generatorSource struct {
+	conf  generatorConfig
+	steps []generatorStep
+	rnd   *rand.Rand
+	zipf  *rand.Zipf
+	c     chan *sarama.ConsumerMessage
+	done  chan struct{}
+	gone  chan struct{} // closed once generate returns
+	log   *log.Entry
+}
+
+type generatorStep struct {
+	topic  string
+	key    *template.Template
+	value  *template.Template
+	fanOut int
+}
+
+// generatorData is what key and value templates are executed against.
+type generatorData struct {
+	FSMId     string
+	Seq       int64
+	Step      int
+	Fan       int
+	Timestamp time.Time
+}
+
+func newGeneratorSource(conf generatorConfig, logger *log.Entry) (*generatorSource, error) {
+	s := &generatorSource{
+		conf: conf,
+		rnd:  rand.New(rand.NewSource(conf.seed)),
+		c:    make(chan *sarama.ConsumerMessage),
+		done: make(chan struct{}),
+		gone: make(chan struct{}),
+		log:  logger,
+	}
+
+	for i, sc := range conf.flow {
+		key, err := template.New("key").Parse(sc.key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key template on flow step %v. err=%v", i, err)
+		}
+		value, err := template.New("value").Parse(sc.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value template on flow step %v. err=%v", i, err)
+		}
+		s.steps = append(s.steps, generatorStep{topic: sc.topic, key: key, value: value, fanOut: sc.fanOut})
+	}
+
+	if conf.distribution == "zipf" {
+		s.zipf = rand.NewZipf(s.rnd, 1.1, 1, uint64(conf.fsmIds-1))
+	}
+
+	go s.generate()
+
+	s.log.WithFields(log.Fields{"rate": conf.rate, "fsmIds": conf.fsmIds, "distribution": conf.distribution, "steps": len(s.steps)}).Info("Generating synthetic messages.")
+	return s, nil
+}
+
+func (s *generatorSource) messages() chan *sarama.ConsumerMessage { return s.c }
+
+// close stops generating, waiting for the generator to be done.
+func (s *generatorSource) close() {
+	close(s.done)
+	<-s.gone
+}
+
+func (s *generatorSource) generate() {
+	defer close(s.gone)
+	var seq, flows int64
+	start := time.Now()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		due := int64(1)
+		if s.conf.rate > 0 {
+			due = int64(time.Since(start).Seconds()*s.conf.rate) - flows
+		}
+
+		for ; due > 0; due-- {
+			if s.conf.limit > 0 && flows >= s.conf.limit {
+				return
+			}
+			for _, cm := range s.flow(&seq) {
+				select {
+				case s.c <- cm:
+				case <-s.done:
+					return
+				}
+			}
+			flows++
+		}
+
+		if s.conf.rate > 0 {
+			select {
+			case <-ticker.C:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+func (s *generatorSource) flow(seq *int64) []*sarama.ConsumerMessage {
+	fsmId := fmt.Sprintf("fsm-%v", s.fsmId())
+
+	cms := []*sarama.ConsumerMessage{}
+	for i, step := range s.steps {
+		for fan := 0; fan < step.fanOut; fan++ {
+			*seq++
+			d := generatorData{FSMId: fsmId, Seq: *seq, Step: i, Fan: fan, Timestamp: time.Now()}
+
+			var key, value bytes.Buffer
+			if err := step.key.Execute(&key, d); err != nil {
+				s.log.WithFields(log.Fields{"err": err, "step": i}).Error("Failed to execute generator key template.")
+			}
+			if err := step.value.Execute(&value, d); err != nil {
+				s.log.WithFields(log.Fields{"err": err, "step": i}).Error("Failed to execute generator value template.")
+			}
+
+			if s.conf.errorRate > 0 && s.rnd.Float64() < s.conf.errorRate {
+				value.Reset()
+				value.WriteString(`{"injected error":`)
+			}
+
+			cms = append(cms, &sarama.ConsumerMessage{
+				Topic:     step.topic,
+				Key:       key.Bytes(),
+				Value:     value.Bytes(),
+				Offset:    *seq,
+				Timestamp: d.Timestamp,
+			})
+		}
+	}
+	return cms
+}
+
+func (s *generatorSource) fsmId() uint64 {
+	if s.zipf != nil {
+		return s.zipf.Uint64()
+	}
+	return uint64(s.rnd.Int63n(int64(s.conf.fsmIds)))
+}
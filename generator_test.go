@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func newTestGenerator(t testing.TB, limit int64, errorRate float64) *generatorSource {
+	g, err := processGeneratorConfig(&generatorConfigJSON{
+		FSMIds:       10,
+		Distribution: "zipf",
+		Limit:        limit,
+		ErrorRate:    errorRate,
+		Seed:         1,
+		Flow: []generatorStepConfigJSON{
+			{Topic: "requests", Key: "{{.FSMId}}", Value: `{"id":"{{.FSMId}}","seq":{{.Seq}}}`},
+			{Topic: "notifications", Key: "{{.FSMId}}", Value: `{"id":"{{.FSMId}}","device":{{.Fan}}}`, FanOut: 3},
+		},
+	})
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	s, err := newGeneratorSource(g, log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	return s
+}
+
+func TestGeneratorFansOutFlows(t *testing.T) {
+	s := newTestGenerator(t, 2, 0)
+	defer s.close()
+
+	expectedTopics := []string{"requests", "notifications", "notifications", "notifications"}
+	for flow := 0; flow < 2; flow++ {
+		var fsmId string
+		for i, expected := range expectedTopics {
+			select {
+			case cm := <-s.messages():
+				if cm.Topic != expected {
+					t.Errorf("expected topic %v but got %v", expected, cm.Topic)
+				}
+				var v map[string]interface{}
+				if err := json.Unmarshal(cm.Value, &v); err != nil {
+					t.Fatalf("expected valid JSON but got %s", cm.Value)
+				}
+				if i == 0 {
+					fsmId = string(cm.Key)
+				}
+				if string(cm.Key) != fsmId || v["id"] != fsmId {
+					t.Errorf("expected all messages in a flow to share fsmId %v; got %v", fsmId, v)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for generated message")
+			}
+		}
+	}
+
+	select {
+	case cm := <-s.messages():
+		t.Errorf("expected generator to stop after its limit; got %+v", cm)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGeneratorInjectsErrors(t *testing.T) {
+	s := newTestGenerator(t, 1, 1)
+	defer s.close()
+
+	cm := <-s.messages()
+	if _, err := newMessage(*cm); err == nil {
+		t.Errorf("expected injected error to produce an unparseable message; got %s", cm.Value)
+	}
+}
+
+func TestProcessGeneratorConfigValidates(t *testing.T) {
+	tests := []generatorConfigJSON{
+		{},
+		{Flow: []generatorStepConfigJSON{{Value: "{}"}}},
+		{Distribution: "normal", Flow: []generatorStepConfigJSON{{Topic: "a"}}},
+		{ErrorRate: 2, Flow: []generatorStepConfigJSON{{Topic: "a"}}},
+		{Rate: -1, Flow: []generatorStepConfigJSON{{Topic: "a"}}},
+		{FSMIds: 1, Distribution: "zipf", Flow: []generatorStepConfigJSON{{Topic: "a"}}},
+	}
+
+	for _, ts := range tests {
+		ts := ts
+		if _, err := processGeneratorConfig(&ts); err == nil {
+			t.Errorf("expected %+v to be rejected", ts)
+		}
+	}
+}
+
+func BenchmarkEventsFromGeneratedMessages(b *testing.B) {
+	s := newTestGenerator(b, 0, 0)
+	defer s.close()
+
+	rules := []rule{
+		{
+			Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "requests"}},
+			Events:   []event{{EventType: "message", SourceId: "Client", TargetId: "Server", FSMId: "{{.Key}}", Aggregate: true}},
+		},
+		{
+			Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "notifications"}},
+			Events:   []event{{EventType: "message", SourceId: "Server", TargetId: `Device {{index .Value "device"}}`, FSMId: "{{.Key}}", Aggregate: true}},
+		},
+	}
+
+	buffer := make([]message, 0, 1000)
+	for len(buffer) < cap(buffer) {
+		m, err := newMessage(*<-s.messages())
+		if err != nil {
+			b.Fatal(err)
+		}
+		buffer = append(buffer, m)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		events, _, err := eventsFrom(buffer, len(buffer), "", rules, map[string]string{}, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := json.Marshal(events); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/Shopify/sarama"
+)
+
+// grepFilter drops messages whose raw bytes don't match, before they are
+// decoded, so searching a busy topic doesn't cost a JSON decode per message.
+type grepFilter struct {
+	substring []byte
+	regex     *regexp.Regexp
+	on        string // value, key or any
+}
+
+func newGrepFilter(k kafka) (*grepFilter, error) {
+	if len(k.Grep) == 0 {
+		return nil, nil
+	}
+
+	g := &grepFilter{substring: []byte(k.Grep), on: k.GrepOn}
+	if g.on == "" {
+		g.on = "value"
+	}
+	if g.on != "value" && g.on != "key" && g.on != "any" {
+		return nil, fmt.Errorf("Invalid grepOn %v; expected value, key or any", k.GrepOn)
+	}
+
+	if k.GrepRegex {
+		re, err := regexp.Compile(k.Grep)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid grep regex %v. err=%v", k.Grep, err)
+		}
+		g.regex = re
+	}
+	return g, nil
+}
+
+// matches tells whether the message should be kept; a nil filter keeps all.
+func (g *grepFilter) matches(cm *sarama.ConsumerMessage) bool {
+	if g == nil {
+		return true
+	}
+
+	switch g.on {
+	case "key":
+		return g.match(cm.Key)
+	case "any":
+		return g.match(cm.Key) || g.match(cm.Value)
+	}
+	return g.match(cm.Value)
+}
+
+func (g *grepFilter) match(b []byte) bool {
+	if g.regex != nil {
+		return g.regex.Match(b)
+	}
+	return bytes.Contains(b, g.substring)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestGrepFilter(t *testing.T) {
+	cm := &sarama.ConsumerMessage{Key: []byte("customer-42"), Value: []byte(`{"customer":"c-1234","amount":10}`)}
+
+	ts := []struct {
+		name    string
+		k       kafka
+		matches bool
+		fails   bool
+	}{
+		{name: "no grep", k: kafka{}, matches: true},
+		{name: "substring on value", k: kafka{Grep: "c-1234"}, matches: true},
+		{name: "substring not on value", k: kafka{Grep: "customer-42"}, matches: false},
+		{name: "substring on key", k: kafka{Grep: "customer-42", GrepOn: "key"}, matches: true},
+		{name: "substring not on key", k: kafka{Grep: "c-1234", GrepOn: "key"}, matches: false},
+		{name: "substring on key or value", k: kafka{Grep: "c-1234", GrepOn: "any"}, matches: true},
+		{name: "regex on value", k: kafka{Grep: `"amount":\d+`, GrepRegex: true}, matches: true},
+		{name: "regex not on value", k: kafka{Grep: `"amount":"`, GrepRegex: true}, matches: false},
+		{name: "regex on key", k: kafka{Grep: `^customer-\d+$`, GrepRegex: true, GrepOn: "key"}, matches: true},
+		{name: "invalid regex", k: kafka{Grep: `(`, GrepRegex: true}, fails: true},
+		{name: "invalid grepOn", k: kafka{Grep: "a", GrepOn: "headers"}, fails: true},
+	}
+
+	for _, tc := range ts {
+		g, err := newGrepFilter(tc.k)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tc.name, err)
+			continue
+		}
+
+		if actual := g.matches(cm); actual != tc.matches {
+			t.Errorf("%v: expected matches to be %v; got %v", tc.name, tc.matches, actual)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	readyzCheckDeps = flag.Bool("readyz-check-deps", false, "make /readyz also check connectivity to the brokers and Bookies that configs use")
+	readyzTimeout   = flag.Duration("readyz-timeout", 2*time.Second, "timeout for each of /readyz's connectivity checks")
+)
+
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+func newHealthCheck(name string, err error) healthCheck {
+	if err != nil {
+		return healthCheck{Name: name, Error: err.Error()}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// healthzHandler serves /healthz, which tells whether this process can serve
+// sessions at all: webroot and the configs in dir are readable and the base
+// page template parsed, as templateErr tells.
+func healthzHandler(dir string, templateErr error) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, localHealthChecks(dir, templateErr))
+	}
+}
+
+// readyzHandler serves /readyz, which on top of /healthz's checks tells
+// whether every config in dir parses, and can verify that the brokers and
+// Bookies that configs reference are reachable. A broken config only breaks
+// sessions using it, so it doesn't fail /healthz.
+func readyzHandler(dir string, templateErr error, checkDeps bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := readConfigs(dir)
+		checks := append(localHealthChecks(dir, templateErr), newHealthCheck("config parsing", err))
+		if checkDeps {
+			checks = append(checks, dependencyHealthChecks(dir, *readyzTimeout)...)
+		}
+		writeHealthReport(w, checks)
+	}
+}
+
+func writeHealthReport(w http.ResponseWriter, checks []healthCheck) {
+	report, status := healthReport{Status: "ok", Checks: checks}, http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			report.Status, status = "failing", http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func localHealthChecks(dir string, templateErr error) []healthCheck {
+	_, err := os.Stat("webroot/index.html")
+	checks := []healthCheck{newHealthCheck("webroot", err)}
+
+	_, err = ioutil.ReadDir(dir)
+	checks = append(checks, newHealthCheck("configs", err))
+
+	return append(checks, newHealthCheck("template", templateErr))
+}
+
+// readConfigs parses every config in dir, keyed by name.
+func readConfigs(dir string) (map[string]configJSON, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := map[string]configJSON{}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var c configJSON
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, fmt.Errorf("Could not parse config %v. err=%v", file.Name(), err)
+		}
+		configs[strings.TrimSuffix(file.Name(), ".json")] = c
+	}
+	return configs, nil
+}
+
+// dependencyHealthChecks checks, concurrently, that every broker of configs
+// that consume from Kafka accepts connections and that every Bookie answers.
+func dependencyHealthChecks(dir string, timeout time.Duration) []healthCheck {
+	configs, err := readConfigs(dir)
+	if err != nil {
+		return nil // already reported by the configs check
+	}
+
+	brokers, bookies := map[string]bool{}, map[string]bool{}
+	for _, c := range configs {
+		if s, err := processSourceConfig(&c); err == nil && s.kind == "kafka" {
+			for _, b := range strings.Split(c.Kafka.Brokers, ",") {
+				if b = strings.TrimSpace(b); b != "" {
+					brokers[b] = true
+				}
+			}
+		}
+		if c.BookieURL != "" {
+			bookies[c.BookieURL] = true
+		}
+	}
+
+	var l sync.Mutex
+	var wg sync.WaitGroup
+	checks := []healthCheck{}
+	check := func(name string, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := newHealthCheck(name, f())
+			l.Lock()
+			checks = append(checks, c)
+			l.Unlock()
+		}()
+	}
+
+	for b := range brokers {
+		b := b
+		check("broker "+b, func() error {
+			conn, err := net.DialTimeout("tcp", b, timeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	}
+	for u := range bookies {
+		b := newBookie(u, log.WithFields(log.Fields{"check": "bookie " + u}))
+		b.client = &http.Client{Timeout: timeout}
+		b.retries, b.cache = 0, nil
+		check("bookie "+b.url, func() error {
+			_, err := b.latestFSMs(1)
+			return err
+		})
+	}
+	wg.Wait()
+
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
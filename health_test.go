@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthzAndReadyzReportLocalChecks(t *testing.T) {
+	broken, err := ioutil.TempDir("", "flowbro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(broken)
+	if err := ioutil.WriteFile(filepath.Join(broken, "broken.json"), []byte(`{"kafka": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := []struct {
+		name           string
+		handler        func(http.ResponseWriter, *http.Request)
+		expectedStatus int
+		expectedChecks int
+	}{
+		{name: "healthy", handler: healthzHandler(mainPath, nil), expectedStatus: http.StatusOK, expectedChecks: 3},
+		{name: "unparsed template", handler: healthzHandler(mainPath, errors.New("bad template")), expectedStatus: http.StatusServiceUnavailable, expectedChecks: 3},
+		{name: "unreadable configs", handler: healthzHandler(filepath.Join(broken, "missing"), nil), expectedStatus: http.StatusServiceUnavailable, expectedChecks: 3},
+		{name: "alive with a broken config", handler: healthzHandler(broken, nil), expectedStatus: http.StatusOK, expectedChecks: 3},
+		{name: "ready without dependency checks", handler: readyzHandler(mainPath, nil, false), expectedStatus: http.StatusOK, expectedChecks: 4},
+		{name: "not ready with a broken config", handler: readyzHandler(broken, nil, false), expectedStatus: http.StatusServiceUnavailable, expectedChecks: 4},
+	}
+
+	for _, tc := range ts {
+		w := httptest.NewRecorder()
+		tc.handler(w, httptest.NewRequest("GET", "/healthz", nil))
+
+		if w.Code != tc.expectedStatus {
+			t.Errorf("[%v] expected status %v but got %v: %v", tc.name, tc.expectedStatus, w.Code, w.Body.String())
+		}
+		var report healthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || len(report.Checks) != tc.expectedChecks {
+			t.Errorf("[%v] expected a report with %v checks; got %v (err=%v)", tc.name, tc.expectedChecks, w.Body.String(), err)
+		}
+	}
+}
+
+func TestDependencyHealthChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowbro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	fb := newFakeBookie()
+	defer fb.Close()
+
+	configs := map[string]string{
+		"up.json":       `{"kafka": {"brokers": "` + broker.Addr().String() + `"}, "bookieURL": "` + fb.URL + `"}`,
+		"down.json":     `{"kafka": {"brokers": "` + down.Addr().String() + `"}}`,
+		"tutorial.json": `{"kafka": {"brokers": "unresolvable.invalid:9092"}, "tutorial": true}`,
+	}
+	for name, c := range configs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]bool{
+		"broker " + broker.Addr().String(): true,
+		"broker " + down.Addr().String():   false,
+		"bookie " + fb.URL:                 true,
+	}
+
+	checks := dependencyHealthChecks(dir, time.Second)
+	if len(checks) != len(expected) {
+		t.Fatalf("expected checks for %v but got %+v", expected, checks)
+	}
+	for _, c := range checks {
+		if ok, exists := expected[c.Name]; !exists || ok != c.OK {
+			t.Errorf("unexpected check %+v; expected %v", c, expected)
+		}
+	}
+}
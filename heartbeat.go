@@ -13,11 +13,11 @@ type heartbeat struct {
 	UUID string `json:"uuid"`
 }
 
-func processHeartbeats(wr wsRecv, out chan struct{}, uuid string, timeoutDuration time.Duration) {
+func processHeartbeats(logger *log.Entry, wr wsRecv, out chan struct{}, uuid string, timeoutDuration time.Duration) {
 	hbCh := make(chan struct{})
 	timeout := time.NewTimer(timeoutDuration)
 
-	go readHeartbeats(wr, hbCh, uuid)
+	go readHeartbeats(logger, wr, hbCh, uuid)
 
 	for {
 		select {
@@ -30,14 +30,14 @@ func processHeartbeats(wr wsRecv, out chan struct{}, uuid string, timeoutDuratio
 	}
 }
 
-func readHeartbeats(wr wsRecv, out chan struct{}, uuid string) {
+func readHeartbeats(logger *log.Entry, wr wsRecv, out chan struct{}, uuid string) {
 	for {
 		hb, err := wr.recv()
 		if err == io.EOF {
 			return
 		}
 		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Error("Error while reading heartbeat.")
+			logger.WithFields(log.Fields{"err": err}).Error("Error while reading heartbeat.")
 			return
 		}
 
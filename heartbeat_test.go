@@ -1,14 +1,18 @@
 package main
 
 import (
+	"io"
 	"testing"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 func TestProcessHeartbeatTimesOut(t *testing.T) {
-	timeout := make(chan struct{})
+	timeout, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
 
-	go processHeartbeats(blockingWR{}, timeout, "uuid", 10*time.Millisecond)
+	go processHeartbeats(log.NewEntry(log.StandardLogger()), blockingWR{done}, timeout, "uuid", 10*time.Millisecond)
 
 	select {
 	case <-timeout:
@@ -18,9 +22,10 @@ func TestProcessHeartbeatTimesOut(t *testing.T) {
 }
 
 func TestProcessHeartbeatTimesOutGivenWrongUUID(t *testing.T) {
-	timeout := make(chan struct{})
+	timeout, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
 
-	go processHeartbeats(invalidWR{}, timeout, "uuid", 10*time.Millisecond)
+	go processHeartbeats(log.NewEntry(log.StandardLogger()), invalidWR{done}, timeout, "uuid", 10*time.Millisecond)
 
 	select {
 	case <-timeout:
@@ -30,9 +35,10 @@ func TestProcessHeartbeatTimesOutGivenWrongUUID(t *testing.T) {
 }
 
 func TestProcessHeartbeatDoesntTimeout(t *testing.T) {
-	timeout := make(chan struct{})
+	timeout, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
 
-	go processHeartbeats(validWR{}, timeout, "uuid", 10*time.Millisecond)
+	go processHeartbeats(log.NewEntry(log.StandardLogger()), validWR{done}, timeout, "uuid", 10*time.Millisecond)
 
 	select {
 	case <-timeout:
@@ -41,10 +47,21 @@ func TestProcessHeartbeatDoesntTimeout(t *testing.T) {
 	}
 }
 
-type blockingWR struct{}
-type invalidWR struct{}
-type validWR struct{}
+// The fake connections below stand in for a WebSocket, whose recv blocks
+// until the next frame, and hang up once the test is done with them.
+type blockingWR struct{ done chan struct{} }
+type invalidWR struct{ done chan struct{} }
+type validWR struct{ done chan struct{} }
+
+func (wr blockingWR) recv() (heartbeat, error) { <-wr.done; return heartbeat{}, io.EOF }
+func (wr invalidWR) recv() (heartbeat, error)  { return nextHeartbeat(wr.done, "invalid") }
+func (wr validWR) recv() (heartbeat, error)    { return nextHeartbeat(wr.done, "uuid") }
 
-func (wr blockingWR) recv() (heartbeat, error) { select {}; return heartbeat{}, nil }
-func (wr invalidWR) recv() (heartbeat, error)  { return heartbeat{UUID: "invalid"}, nil }
-func (wr validWR) recv() (heartbeat, error)    { return heartbeat{UUID: "uuid"}, nil }
+func nextHeartbeat(done chan struct{}, uuid string) (heartbeat, error) {
+	select {
+	case <-done:
+		return heartbeat{}, io.EOF
+	case <-time.After(time.Millisecond):
+		return heartbeat{UUID: uuid}, nil
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+var indexConfigPath = flag.String("index-config", "", "path to an indexer config; enables the embedded FSM indexer, served on /index as a Bookie replacement")
+
+// indexer is a lightweight, embedded alternative to Bookie. It consumes the
+// configured topics in the background, extracts each message's FSM id with a
+// template like rules do, and keeps per-FSM partition offsets and tags in a
+// local store. It serves them with the same API Bookie has, so configs can use
+// it by setting "bookieURL": "localhost:41234/index".
+type indexer struct {
+	conf   indexerConfig
+	fsmId  *template.Template
+	tags   map[string]*template.Template
+	client sarama.Client
+
+	l       sync.RWMutex
+	fsms    map[string]*fsm
+	offsets map[string]map[int32]int64 // next offset to index, per topic and partition
+	dirty   bool
+
+	done chan struct{}
+}
+
+type indexerConfigJSON struct {
+	Brokers string            `json:"brokers"`
+	Topics  []string          `json:"topics"`
+	FSMId   string            `json:"fsmId"`
+	Tags    map[string]string `json:"tags"`
+	Store   string            `json:"store"`
+	Offset  string            `json:"offset"`
+	MaxFSMs int               `json:"maxFSMs"`
+}
+
+type indexerConfig struct {
+	brokers []string
+	topics  []string
+	fsmId   string
+	tags    map[string]string
+	store   string
+	offset  string
+	maxFSMs int
+}
+
+// indexStore is what gets persisted to the store file.
+type indexStore struct {
+	FSMs    map[string]*fsm            `json:"fsms"`
+	Offsets map[string]map[int32]int64 `json:"offsets"`
+}
+
+func loadIndexerConfig(path string) (indexerConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return indexerConfig{}, err
+	}
+
+	var cJSON indexerConfigJSON
+	if err := json.Unmarshal(raw, &cJSON); err != nil {
+		return indexerConfig{}, err
+	}
+
+	c := indexerConfig{
+		brokers: strings.Split(cJSON.Brokers, ","),
+		topics:  cJSON.Topics,
+		fsmId:   cJSON.FSMId,
+		tags:    cJSON.Tags,
+		store:   cJSON.Store,
+		offset:  cJSON.Offset,
+		maxFSMs: cJSON.MaxFSMs,
+	}
+
+	if len(cJSON.Brokers) == 0 || len(c.topics) == 0 {
+		return c, fmt.Errorf("Please define brokers and topics for the indexer")
+	}
+	if len(c.fsmId) == 0 {
+		return c, fmt.Errorf("Please define an fsmId template for the indexer")
+	}
+	if c.store == "" {
+		c.store = "index.json"
+	}
+	if c.offset == "" {
+		c.offset = "oldest"
+	}
+	if c.offset != "oldest" && c.offset != "newest" {
+		return c, fmt.Errorf("Invalid indexer offset %v; use oldest or newest", c.offset)
+	}
+	if c.maxFSMs == 0 {
+		c.maxFSMs = 100000
+	}
+
+	return c, nil
+}
+
+func newIndexer(conf indexerConfig) (*indexer, error) {
+	idx := &indexer{
+		conf:    conf,
+		tags:    map[string]*template.Template{},
+		fsms:    map[string]*fsm{},
+		offsets: map[string]map[int32]int64{},
+		done:    make(chan struct{}),
+	}
+
+	var err error
+	if idx.fsmId, err = template.New("fsmId").Parse(conf.fsmId); err != nil {
+		return nil, fmt.Errorf("Invalid fsmId template. err=%v", err)
+	}
+	for k, t := range conf.tags {
+		if idx.tags[k], err = template.New(k).Parse(t); err != nil {
+			return nil, fmt.Errorf("Invalid template for tag %v. err=%v", k, err)
+		}
+	}
+
+	if err := idx.load(); err != nil {
+		return nil, fmt.Errorf("Could not load index store %v. err=%v", conf.store, err)
+	}
+
+	return idx, nil
+}
+
+// start connects to Kafka and indexes every partition of the configured
+// topics in the background, resuming from the stored offsets.
+func (idx *indexer) start() error {
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = saramaVersion
+	client, err := sarama.NewClient(idx.conf.brokers, saramaConfig)
+	if err != nil {
+		return fmt.Errorf("Error creating client. err=%v", err)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("Error creating consumer. err=%v", err)
+	}
+	idx.client = client
+
+	for _, topic := range idx.conf.topics {
+		partitions, err := consumer.Partitions(topic)
+		if err != nil {
+			client.Close()
+			return fmt.Errorf("Error fetching partitions for topic %v. err=%v", topic, err)
+		}
+
+		for _, partition := range partitions {
+			offset := idx.startOffset(topic, partition)
+			pc, err := consumer.ConsumePartition(topic, partition, offset)
+			if err == sarama.ErrOffsetOutOfRange {
+				log.WithFields(log.Fields{"topic": topic, "partition": partition, "offset": offset}).Warn("Stored index offset is gone from Kafka; indexing from the oldest.")
+				pc, err = consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+			}
+			if err != nil {
+				client.Close()
+				return fmt.Errorf("Failed to consume topic %v partition %v. err=%v", topic, partition, err)
+			}
+
+			go func(pc sarama.PartitionConsumer) {
+				for cm := range pc.Messages() {
+					idx.add(cm)
+				}
+			}(pc)
+			log.WithFields(log.Fields{"topic": topic, "partition": partition, "offset": offset}).Info("Indexing partition.")
+		}
+	}
+
+	go idx.persistEvery(10 * time.Second)
+	return nil
+}
+
+func (idx *indexer) startOffset(topic string, partition int32) int64 {
+	idx.l.RLock()
+	defer idx.l.RUnlock()
+
+	if o, ok := idx.offsets[topic][partition]; ok {
+		return o
+	}
+	if idx.conf.offset == "newest" {
+		return sarama.OffsetNewest
+	}
+	return sarama.OffsetOldest
+}
+
+func (idx *indexer) close() {
+	close(idx.done)
+	if idx.client != nil {
+		idx.client.Close()
+	}
+	if err := idx.save(); err != nil {
+		log.WithFields(log.Fields{"err": err, "store": idx.conf.store}).Error("Could not save index store.")
+	}
+}
+
+func (idx *indexer) add(cm *sarama.ConsumerMessage) {
+	fsmId, tags := "", map[string]string{}
+	if m, err := newMessage(*cm); err == nil {
+		fsmId = idx.execute(idx.fsmId, m)
+		for k, t := range idx.tags {
+			if v := idx.execute(t, m); v != "" {
+				tags[k] = v
+			}
+		}
+	}
+
+	idx.l.Lock()
+	defer idx.l.Unlock()
+	idx.dirty = true
+
+	if idx.offsets[cm.Topic] == nil {
+		idx.offsets[cm.Topic] = map[int32]int64{}
+	}
+	idx.offsets[cm.Topic][cm.Partition] = cm.Offset + 1
+
+	if fsmId == "" {
+		return
+	}
+
+	f, ok := idx.fsms[fsmId]
+	if !ok {
+		created := cm.Timestamp
+		if created.IsZero() {
+			created = time.Now()
+		}
+		f = &fsm{Id: fsmId, Created: created.UTC().Format("2006-01-02T15:04:05Z"), Topics: map[string]topic{}, Tags: map[string]string{}}
+		idx.fsms[fsmId] = f
+	}
+	for k, v := range tags {
+		f.Tags[k] = v
+	}
+
+	t := f.Topics[cm.Topic]
+	if t.Partitions == nil {
+		t.Partitions = map[string]partition{}
+	}
+	key := strconv.Itoa(int(cm.Partition))
+	p, ok := t.Partitions[key]
+	if !ok {
+		p.Start = cm.Offset
+	}
+	p.End = cm.Offset
+	p.Count++
+	t.Partitions[key] = p
+	t.Count++
+	f.Topics[cm.Topic] = t
+}
+
+func (idx *indexer) execute(t *template.Template, m message) string {
+	var b bytes.Buffer
+	if err := t.Execute(&b, m); err != nil {
+		return ""
+	}
+
+	v := strings.TrimSpace(b.String())
+	if v == "<no value>" { // i.e. a missing key on the message's value
+		return ""
+	}
+	return v
+}
+
+// fsm returns a copy of the indexed FSM, with each partition's LastScraped
+// set to the last offset indexed on it.
+func (idx *indexer) fsm(id string) (fsm, bool) {
+	idx.l.RLock()
+	defer idx.l.RUnlock()
+
+	f, ok := idx.fsms[id]
+	if !ok {
+		return fsm{}, false
+	}
+	return idx.copyFSM(f), true
+}
+
+func (idx *indexer) copyFSM(f *fsm) fsm {
+	c := fsm{Id: f.Id, Created: f.Created, Topics: map[string]topic{}, Tags: map[string]string{}}
+	for k, v := range f.Tags {
+		c.Tags[k] = v
+	}
+	for name, t := range f.Topics {
+		ct := topic{Count: t.Count, Partitions: map[string]partition{}}
+		for key, p := range t.Partitions {
+			if n, err := strconv.Atoi(key); err == nil {
+				if o, ok := idx.offsets[name][int32(n)]; ok {
+					p.LastScraped = o - 1
+				}
+			}
+			ct.Partitions[key] = p
+		}
+		c.Topics[name] = ct
+	}
+	return c
+}
+
+// search returns up to q.n matching FSMs, oldest first among the latest ones.
+func (idx *indexer) search(q fsmQuery) []fsm {
+	idx.l.RLock()
+	defer idx.l.RUnlock()
+
+	matches := []*fsm{}
+	for _, f := range idx.fsms {
+		if idx.matches(f, q) {
+			matches = append(matches, f)
+		}
+	}
+	sortByCreated(matches)
+
+	if q.n > 0 && len(matches) > q.n {
+		matches = matches[len(matches)-q.n:]
+	}
+
+	fsms := []fsm{}
+	for _, f := range matches {
+		fsms = append(fsms, idx.copyFSM(f))
+	}
+	return fsms
+}
+
+func (idx *indexer) matches(f *fsm, q fsmQuery) bool {
+	if !strings.HasPrefix(f.Id, q.prefix) {
+		return false
+	}
+	for k, v := range q.tags {
+		if f.Tags[k] != v {
+			return false
+		}
+	}
+	if q.from.IsZero() && q.to.IsZero() {
+		return true
+	}
+
+	created, err := time.Parse("2006-01-02T15:04:05Z", f.Created)
+	if err != nil {
+		return false
+	}
+	return (q.from.IsZero() || !created.Before(q.from)) && (q.to.IsZero() || !created.After(q.to))
+}
+
+func sortByCreated(fsms []*fsm) {
+	sort.Slice(fsms, func(i, j int) bool {
+		if fsms[i].Created != fsms[j].Created {
+			return fsms[i].Created < fsms[j].Created
+		}
+		return fsms[i].Id < fsms[j].Id
+	})
+}
+
+func (idx *indexer) persistEvery(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			idx.evict()
+			if err := idx.save(); err != nil {
+				log.WithFields(log.Fields{"err": err, "store": idx.conf.store}).Error("Could not save index store.")
+			}
+		case <-idx.done:
+			return
+		}
+	}
+}
+
+// evict drops the oldest FSMs beyond the configured maximum.
+func (idx *indexer) evict() {
+	idx.l.Lock()
+	defer idx.l.Unlock()
+
+	if len(idx.fsms) <= idx.conf.maxFSMs {
+		return
+	}
+
+	fsms := []*fsm{}
+	for _, f := range idx.fsms {
+		fsms = append(fsms, f)
+	}
+	sortByCreated(fsms)
+
+	for _, f := range fsms[:len(fsms)-idx.conf.maxFSMs] {
+		delete(idx.fsms, f.Id)
+	}
+	idx.dirty = true
+}
+
+func (idx *indexer) load() error {
+	raw, err := ioutil.ReadFile(idx.conf.store)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s indexStore
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	if s.FSMs != nil {
+		idx.fsms = s.FSMs
+	}
+	if s.Offsets != nil {
+		idx.offsets = s.Offsets
+	}
+	return nil
+}
+
+// save writes the store if anything changed, replacing the previous file
+// atomically.
+func (idx *indexer) save() error {
+	idx.l.Lock()
+	if !idx.dirty {
+		idx.l.Unlock()
+		return nil
+	}
+	byt, err := json.Marshal(indexStore{FSMs: idx.fsms, Offsets: idx.offsets})
+	idx.dirty = false
+	idx.l.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := idx.conf.store + ".tmp"
+	if err := ioutil.WriteFile(tmp, byt, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.conf.store)
+}
+
+// handler serves the index under prefix with the same API as Bookie: /fsm,
+// /latest and /search.
+func (idx *indexer) handler(prefix string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var resp interface{}
+
+		switch strings.TrimPrefix(r.URL.Path, prefix) {
+		case "/fsm":
+			f, ok := idx.fsm(r.URL.Query().Get("id"))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			resp = f
+		case "/latest":
+			n, err := strconv.Atoi(r.URL.Query().Get("n"))
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid n", http.StatusBadRequest)
+				return
+			}
+			resp = idx.search(fsmQuery{n: n})
+		case "/search":
+			q, err := parseFSMQuery(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp = idx.search(q)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
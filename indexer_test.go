@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+func newTestIndexer(t *testing.T, store string) *indexer {
+	idx, err := newIndexer(indexerConfig{
+		fsmId:   `{{.Value.orderId}}`,
+		tags:    map[string]string{"user": `{{.Value.user}}`},
+		store:   store,
+		maxFSMs: 2,
+	})
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	return idx
+}
+
+func indexTestMessages(idx *indexer) {
+	ts := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, cm := range []*sarama.ConsumerMessage{
+		{Topic: "orders", Partition: 0, Offset: 10, Timestamp: ts, Value: []byte(`{"orderId":"o1","user":"alice"}`)},
+		{Topic: "orders", Partition: 1, Offset: 5, Timestamp: ts.Add(time.Minute), Value: []byte(`{"orderId":"o2"}`)},
+		{Topic: "orders", Partition: 0, Offset: 11, Timestamp: ts, Value: []byte(`{"unrelated":true}`)},
+		{Topic: "payments", Partition: 3, Offset: 7, Timestamp: ts, Value: []byte(`{"orderId":"o1"}`)},
+		{Topic: "orders", Partition: 0, Offset: 12, Timestamp: ts, Value: []byte(`{"orderId":"o1"}`)},
+		{Topic: "orders", Partition: 0, Offset: 13, Timestamp: ts, Value: []byte(`not json`)},
+	} {
+		idx.add(cm)
+	}
+}
+
+func TestIndexerServesBookieAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowbro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx := newTestIndexer(t, filepath.Join(dir, "index.json"))
+	indexTestMessages(idx)
+
+	s := httptest.NewServer(http.HandlerFunc(idx.handler("/index")))
+	defer s.Close()
+	b := newBookie(s.URL+"/index", log.NewEntry(log.StandardLogger()))
+	b.cache = newBookieCache()
+
+	f, err := b.fsm("o1")
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	expected := fsm{
+		Id:      "o1",
+		Created: "2017-01-02T15:04:05Z",
+		Tags:    map[string]string{"user": "alice"},
+		Topics: map[string]topic{
+			"orders":   {Count: 2, Partitions: map[string]partition{"0": {Start: 10, End: 12, LastScraped: 13, Count: 2}}},
+			"payments": {Count: 1, Partitions: map[string]partition{"3": {Start: 7, End: 7, LastScraped: 7, Count: 1}}},
+		},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %+v but got %+v", expected, f)
+	}
+
+	if _, err := b.fsm("missing"); err == nil {
+		t.Error("expected missing FSM to fail")
+	}
+
+	latest, err := b.latestFSMs(10)
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(latest) != 2 || latest[0].Id != "o1" || latest[1].Id != "o2" {
+		t.Errorf("expected latest FSMs [o1 o2]; got %+v", latest)
+	}
+
+	found, err := b.search(fsmQuery{tags: map[string]string{"user": "alice"}})
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(found) != 1 || found[0].Id != "o1" {
+		t.Errorf("expected search to find [o1]; got %+v", found)
+	}
+}
+
+func TestIndexerPersistsAndResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowbro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, "index.json")
+
+	idx := newTestIndexer(t, store)
+	indexTestMessages(idx)
+	idx.add(&sarama.ConsumerMessage{Topic: "orders", Partition: 2, Offset: 1, Timestamp: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), Value: []byte(`{"orderId":"o3"}`)})
+	idx.evict()
+	if err := idx.save(); err != nil {
+		t.Fatalf("shouldn't have failed saving, but did with %v", err)
+	}
+
+	resumed := newTestIndexer(t, store)
+	if _, ok := resumed.fsm("o1"); ok {
+		t.Error("expected oldest FSM to have been evicted beyond maxFSMs")
+	}
+	if _, ok := resumed.fsm("o3"); !ok {
+		t.Error("expected newest FSM to have been persisted")
+	}
+	if o := resumed.startOffset("orders", 0); o != 14 {
+		t.Errorf("expected to resume partition 0 after the last indexed offset; got %v", o)
+	}
+	if o := resumed.startOffset("orders", 9); o != sarama.OffsetOldest {
+		t.Errorf("expected unknown partitions to start from the oldest offset; got %v", o)
+	}
+}
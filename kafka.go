@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/Shopify/sarama"
 	log "github.com/Sirupsen/logrus"
@@ -11,22 +16,59 @@ import (
 
 type cluster struct {
 	brokers  []string
+	fsmId    string
 	consumer sarama.Consumer
 	client   sarama.Client
+	log      *log.Entry
 
 	partitionConsumers []sarama.PartitionConsumer
 	pcLock             sync.Mutex
 
-	chs     []<-chan *sarama.ConsumerMessage
-	chsLock sync.Mutex
+	chs       []<-chan *sarama.ConsumerMessage
+	consuming map[string]map[int32]bool
+	followed  []consumerConfig // consumers whose new topics and partitions are picked up mid-session
+	more      chan (<-chan *sarama.ConsumerMessage)
+	chsLock   sync.Mutex
+
+	replays     []*replayProgress
+	replaysLock sync.Mutex
+
+	stats     []*partitionStats
+	statsLock sync.Mutex
+
+	onError func(error) // reports consumer errors to whoever is consuming
+	closing bool        // guarded by pcLock
+	closed  chan struct{}
+
+	metricLabels []string // config and session, telling apart sessions' per-partition metrics
 
 	es errorlist
 }
 
-func (c *cluster) addPartitionConsumer(pc sarama.PartitionConsumer) {
+// addPartitionConsumer tracks pc so that closing the cluster closes it,
+// returning false if the cluster is already closed.
+func (c *cluster) addPartitionConsumer(pc sarama.PartitionConsumer) bool {
 	c.pcLock.Lock()
+	defer c.pcLock.Unlock()
+	if c.closing {
+		return false
+	}
 	c.partitionConsumers = append(c.partitionConsumers, pc)
-	c.pcLock.Unlock()
+	return true
+}
+
+// removePartitionConsumer forgets pc, returning false if it was already gone,
+// so that whoever removes it is the only one closing it.
+func (c *cluster) removePartitionConsumer(pc sarama.PartitionConsumer) bool {
+	c.pcLock.Lock()
+	defer c.pcLock.Unlock()
+	for i, p := range c.partitionConsumers {
+		if p == pc {
+			c.partitionConsumers = append(c.partitionConsumers[:i], c.partitionConsumers[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 func (c *cluster) addCh(ch <-chan *sarama.ConsumerMessage) {
@@ -36,68 +78,290 @@ func (c *cluster) addCh(ch <-chan *sarama.ConsumerMessage) {
 }
 
 func (c *cluster) close() {
-	log.Printf("Trying to close cluster with brokers %v", c.brokers)
+	c.pcLock.Lock()
+	if c.closing {
+		c.pcLock.Unlock()
+		return
+	}
+	c.closing = true
+	close(c.closed)
+	pcs := c.partitionConsumers
+	c.partitionConsumers = nil
+	c.pcLock.Unlock()
 
-	log.Printf("Trying to close %v partition consumers for cluster with brokers %v", len(c.partitionConsumers), c.brokers)
-	cc := 0
-	for _, pc := range c.partitionConsumers {
+	c.log.WithFields(log.Fields{"partitionConsumers": len(pcs)}).Debug("Closing cluster.")
+	for _, pc := range pcs {
 		if err := pc.Close(); err != nil {
-			log.Printf("Error while trying to close partition consumer for cluster with brokers %v. err=%v", c.brokers, err)
+			c.log.WithFields(log.Fields{"err": err}).Error("Error while trying to close partition consumer.")
 		}
-		cc++
 	}
 
-	if cc > 0 {
-		log.Printf("Trying to close consumer for cluster with brokers %v", c.brokers)
+	if c.client != nil {
 		if err := c.consumer.Close(); err != nil {
-			log.Printf("Error while trying to close consumer for cluster with brokers %v. err=%v", c.brokers, err)
-		} else {
-			log.Printf("Successfully closed consumer for cluster with brokers %v", c.brokers)
+			c.log.WithFields(log.Fields{"err": err}).Error("Error while trying to close consumer.")
 		}
-		log.Printf("Trying to close client for cluster with brokers %v", c.brokers)
 		if err := c.client.Close(); err != nil {
-			log.Printf("Error while trying to close client for cluster with brokers %v. err=%v", c.brokers, err)
-		} else {
-			log.Printf("Successfully closed client for cluster with brokers %v", c.brokers)
+			c.log.WithFields(log.Fields{"err": err}).Error("Error while trying to close client.")
 		}
 	}
-	log.Printf("Finished trying to close cluster with brokers %v", c.brokers)
+	c.forgetLags()
+	c.log.Info("Closed cluster.")
 }
 
 func (c *cluster) addConsumer(conf consumerConfig, fsm fsm) {
-	topic, brokers, partition := conf.topic, conf.brokers, conf.partition
+	topics, err := resolveTopics(conf, c.client)
+	if err != nil {
+		c.es.add(err.Error())
+		return
+	}
+	if len(topics) == 0 {
+		c.log.WithFields(log.Fields{"topicRegex": conf.topicRegex}).Warn("No topics match yet.")
+	}
+
+	for _, topic := range topics {
+		if !c.addTopic(conf, topic, fsm) {
+			return
+		}
+	}
+
+	// Replays of an FSM known to Bookie or keyed to a partition have nothing to
+	// gain from following new topics and partitions.
+	if conf.partition == -1 && len(conf.partitions) == 0 && len(fsm.Topics) == 0 && (conf.key == nil || c.fsmId == "") {
+		c.chsLock.Lock()
+		c.followed = append(c.followed, conf)
+		c.chsLock.Unlock()
+	}
+}
+
+// addTopic starts consuming the topic's configured partitions, returning
+// false if it failed to.
+func (c *cluster) addTopic(conf consumerConfig, topic string, fsm fsm) bool {
+	brokers, partition := conf.brokers, conf.partition
 	client, consumer := c.client, c.consumer
 
-	partitions, err := resolvePartitions(topic, partition, consumer)
+	partitions, err := resolvePartitions(topic, partition, conf.partitions, consumer)
 	if err != nil {
 		c.es.add(err.Error())
-		return
+		return false
+	}
+
+	// If Bookie knows which partitions the FSM lives on, the rest are skipped
+	// and each known one is only consumed up to the FSM's last message, if
+	// Bookie knows that too.
+	bounds, bounded := fsm.partitions(topic)
+
+	// Otherwise, if it's known how the topic is keyed, only the partition the
+	// FSM's messages hash to is consumed.
+	if !bounded && conf.key != nil && c.fsmId != "" {
+		p, err := keyPartition(conf.key, c.fsmId, partitions)
+		if err != nil {
+			c.es.add(fmt.Sprintf("Could not work out the partition of FSM %v on topic %v. err=%v", c.fsmId, topic, err))
+			return false
+		}
+		c.log.WithFields(log.Fields{"topic": topic, "partition": p, "fsmId": c.fsmId}).Info("Consuming only the partition the FSM's key hashes to.")
+		partitions = []int32{p}
 	}
 
 	for _, partition := range partitions {
-		offset, err := resolveOffset(fsm, conf.offset, topic, partition, client)
+		bound, ok := bounds[partition]
+		if bounded && !ok {
+			c.log.WithFields(log.Fields{"topic": topic, "partition": partition, "fsmId": fsm.Id}).Info("Skipping partition the FSM never touched.")
+			continue
+		}
+
+		offset, err := resolveOffset(c.log, fsm, conf.offsetFor(partition), topic, partition, client)
 		if err != nil {
 			c.es.add(fmt.Sprintf("Could not resolve offset for %v, %v, %v. err=%v", brokers, topic, partition, err))
-			return
+			return false
+		}
+
+		// Bookies that don't report where FSMs end leave End at 0.
+		ends := ok && bound.End >= bound.Start
+		if ends && offset > bound.End {
+			c.log.WithFields(log.Fields{"topic": topic, "partition": partition, "fsmId": fsm.Id, "offset": offset, "end": bound.End}).Warn("Skipping partition as the FSM's messages are no longer on Kafka.")
+			continue
+		}
+
+		if !c.markConsuming(topic, partition) {
+			continue
 		}
 
 		partitionConsumer, err := consumer.ConsumePartition(topic, int32(partition), offset)
 		if err != nil {
 			c.es.add(fmt.Sprintf("Failed to consume partition %v err=%v\n", partition, err))
-			return
+			return false
 		}
 
 		c.addPartitionConsumer(partitionConsumer)
-		c.addCh(partitionConsumer.Messages())
-		log.Printf("Consuming topic [%v], partition [%v] from offset [%v]", topic, partition, offset)
+		ps := c.track(partitionConsumer, topic, partition, offset)
+		if ends {
+			rp := &replayProgress{topic: topic, partition: partition, start: offset, end: bound.End, count: bound.Count}
+			c.addReplay(rp)
+			c.addCh(c.consume(partitionConsumer, ps, rp))
+			c.log.WithFields(log.Fields{"topic": topic, "partition": partition, "offset": offset, "end": bound.End}).Info("Consuming partition up to the FSM's last message.")
+			continue
+		}
+		c.addCh(c.consume(partitionConsumer, ps, nil))
+		c.log.WithFields(log.Fields{"topic": topic, "partition": partition, "offset": offset}).Info("Consuming partition.")
+	}
+	return true
+}
+
+// markConsuming records that the partition is being consumed, returning false
+// if it already was, e.g. because two consumers' topics overlap.
+func (c *cluster) markConsuming(topic string, partition int32) bool {
+	c.chsLock.Lock()
+	defer c.chsLock.Unlock()
+
+	if c.consuming == nil {
+		c.consuming = map[string]map[int32]bool{}
+	}
+	if c.consuming[topic] == nil {
+		c.consuming[topic] = map[int32]bool{}
+	}
+	if c.consuming[topic][partition] {
+		return false
 	}
+	c.consuming[topic][partition] = true
+	return true
 }
 
-func setupCluster(conf *config, f fsm) cluster {
-	c := cluster{brokers: conf.brokers}
+// unmarkConsuming undoes markConsuming for a partition that couldn't be
+// consumed after all, so that it's tried again.
+func (c *cluster) unmarkConsuming(topic string, partition int32) {
+	c.chsLock.Lock()
+	defer c.chsLock.Unlock()
+	delete(c.consuming[topic], partition)
+}
+
+// consumerRetryBackoff is how long to wait before re-creating a partition
+// consumer that died.
+var consumerRetryBackoff = 2 * time.Second
+
+// consume forwards the partition's messages until the cluster is closed or,
+// for replays, until the one at rp's end offset. Consumer errors are
+// reported, and if the partition consumer dies before then, e.g. because
+// retention deleted the offset it was at, it's re-created where it left off.
+func (c *cluster) consume(pc sarama.PartitionConsumer, ps *partitionStats, rp *replayProgress) <-chan *sarama.ConsumerMessage {
+	out := make(chan *sarama.ConsumerMessage)
+	go func() {
+		defer close(out)
+		for c.forward(pc, ps, rp, out) {
+			c.removePartitionConsumer(pc)
+			c.log.WithFields(log.Fields{"topic": ps.topic, "partition": ps.partition}).Warn("Partition consumer died; re-creating it.")
+			if pc = c.reconsume(ps); pc == nil {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// forward forwards pc's messages and reports its errors, returning whether pc
+// died and should be re-created.
+func (c *cluster) forward(pc sarama.PartitionConsumer, ps *partitionStats, rp *replayProgress, out chan<- *sarama.ConsumerMessage) bool {
+	errs := pc.Errors()
+	for {
+		select {
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				if errs != nil { // errors may still be buffered; they're closed right after messages
+					for err := range errs {
+						c.reportError(err)
+					}
+				}
+				select {
+				case <-c.closed:
+					return false
+				default:
+					return true
+				}
+			}
+
+			select {
+			case out <- msg:
+			case <-c.closed:
+				return false
+			}
+			c.consumed(ps, msg)
+
+			if rp != nil && c.replayed(rp, msg) {
+				if c.removePartitionConsumer(pc) {
+					if err := pc.Close(); err != nil {
+						c.log.WithFields(log.Fields{"err": err, "topic": rp.topic, "partition": rp.partition}).Error("Error while closing partition consumer after reaching the FSM's last message.")
+					}
+				}
+				return false
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			c.reportError(err)
+		}
+	}
+}
+
+// reconsume re-creates the partition consumer ps is tracking, from the next
+// offset it was due to consume, retrying until it succeeds or the cluster is
+// closed.
+func (c *cluster) reconsume(ps *partitionStats) sarama.PartitionConsumer {
+	for {
+		select {
+		case <-time.After(consumerRetryBackoff):
+		case <-c.closed:
+			return nil
+		}
+
+		offset := ps.resumeOffset()
+		pc, err := c.consumer.ConsumePartition(ps.topic, ps.partition, offset)
+		if err == sarama.ErrOffsetOutOfRange {
+			offset = sarama.OffsetOldest
+			pc, err = c.consumer.ConsumePartition(ps.topic, ps.partition, offset)
+		}
+		if err != nil {
+			c.reportError(fmt.Errorf("Could not re-create consumer for %v/%v; will retry. err=%v", ps.topic, ps.partition, err))
+			continue
+		}
+
+		if !c.addPartitionConsumer(pc) {
+			pc.Close()
+			return nil
+		}
+		c.statsLock.Lock()
+		ps.pc = pc
+		c.statsLock.Unlock()
+
+		c.log.WithFields(log.Fields{"topic": ps.topic, "partition": ps.partition, "offset": offset}).Info("Re-created partition consumer.")
+		return pc
+	}
+}
+
+func (c *cluster) reportError(err error) {
+	c.log.WithFields(log.Fields{"err": err}).Warn("Error while consuming.")
+	if c.onError != nil {
+		c.onError(err)
+	}
+}
+
+// saramaVersion is the Kafka protocol version flowbro speaks; 0.10 is needed
+// for message timestamps.
+var saramaVersion = sarama.V0_10_0_0
+
+func setupCluster(conf *config, f fsm, session string, logger *log.Entry, onError func(error)) *cluster {
+	c := &cluster{
+		brokers:      conf.brokers,
+		fsmId:        conf.fsmId,
+		log:          logger.WithFields(log.Fields{"brokers": conf.brokers}),
+		onError:      onError,
+		metricLabels: []string{"config", metricConfig(conf.name), "session", session},
+		closed:       make(chan struct{}),
+	}
 
 	saramaConfig := sarama.NewConfig()
-	saramaConfig.Version = sarama.V0_10_0_0
+	saramaConfig.Version = saramaVersion
+	saramaConfig.Consumer.Return.Errors = true
 	client, err := sarama.NewClient(c.brokers, saramaConfig)
 	if err != nil {
 		c.es.add(fmt.Sprintf("Error creating client. err=%v", err))
@@ -119,16 +383,53 @@ func setupCluster(conf *config, f fsm) cluster {
 		go func(consumerConf consumerConfig, f fsm, c *cluster, wg *sync.WaitGroup) {
 			defer wg.Done()
 			c.addConsumer(consumerConf, f)
-		}(consumerConf, f, &c, &wg)
+		}(consumerConf, f, c, &wg)
 	}
 	wg.Wait()
 
 	return c
 }
 
-func resolvePartitions(topic string, partition int, consumer sarama.Consumer) ([]int32, error) {
+// resolveTopics returns the consumer's topic or, if it has a regex, every
+// topic that currently matches it.
+func resolveTopics(conf consumerConfig, client sarama.Client) ([]string, error) {
+	if conf.topicRegex == nil {
+		return []string{conf.topic}, nil
+	}
+
+	all, err := client.Topics()
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching topics to match against %v. err=%v", conf.topicRegex, err)
+	}
+
+	topics := []string{}
+	for _, t := range all {
+		if conf.topicRegex.MatchString(t) {
+			topics = append(topics, t)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+func resolvePartitions(topic string, partition int, listed []int32, consumer sarama.Consumer) ([]int32, error) {
 	var partitions []int32
-	if partition == -1 {
+	if len(listed) > 0 {
+		all, err := consumer.Partitions(topic)
+		if err != nil {
+			return partitions, fmt.Errorf("Error fetching partitions for topic %v. err=%v", topic, err)
+		}
+		exists := map[int32]bool{}
+		for _, p := range all {
+			exists[p] = true
+		}
+		for _, p := range listed {
+			if !exists[p] {
+				return partitions, fmt.Errorf("Topic %v has no partition %v", topic, p)
+			}
+		}
+		partitions = listed
+	} else if partition == -1 {
 		var err error
 
 		partitions, err = consumer.Partitions(topic)
@@ -141,7 +442,7 @@ func resolvePartitions(topic string, partition int, consumer sarama.Consumer) ([
 	return partitions, nil
 }
 
-func resolveOffset(fsm fsm, configOffset string, topic string, partition int32, client sarama.Client) (int64, error) {
+func resolveOffset(logger *log.Entry, fsm fsm, configOffset string, topic string, partition int32, client sarama.Client) (int64, error) {
 	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
 	if err != nil {
 		return 0, err
@@ -153,10 +454,26 @@ func resolveOffset(fsm fsm, configOffset string, topic string, partition int32,
 			return bookieOffset, nil
 		}
 
-		log.WithFields(log.Fields{"oldest": oldest, "bookieOffset": bookieOffset}).Error("Bookie's offset is older than Kafka's oldest.")
+		logger.WithFields(log.Fields{"topic": topic, "partition": partition, "oldest": oldest, "bookieOffset": bookieOffset}).Error("Bookie's offset is older than Kafka's oldest.")
 		return oldest, nil
 	}
 
+	if strings.HasPrefix(configOffset, "group:") {
+		group, back, err := parseGroupOffset(configOffset)
+		if err != nil {
+			return 0, err
+		}
+		committed, err := committedOffset(client, group, topic, partition)
+		if err != nil {
+			return 0, err
+		}
+		if committed-back < oldest {
+			logger.WithFields(log.Fields{"topic": topic, "partition": partition, "group": group, "committed": committed, "oldest": oldest}).Warn("Starting from Kafka's oldest offset, as the group's is no longer on Kafka.")
+			return oldest, nil
+		}
+		return committed - back, nil
+	}
+
 	if configOffset == "oldest" {
 		return sarama.OffsetOldest, nil
 	}
@@ -174,29 +491,138 @@ func resolveOffset(fsm fsm, configOffset string, topic string, partition int32,
 		return numericOffset, nil
 	}
 
+	return lastOffset(client, topic, partition, -numericOffset, oldest)
+}
+
+// lastOffset returns the offset n messages before the partition's newest, or
+// its oldest if there aren't as many.
+func lastOffset(client sarama.Client, topic string, partition int32, n int64, oldest int64) (int64, error) {
 	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
 	if err != nil {
 		return 0, err
 	}
 
-	if newest+numericOffset < oldest {
+	if newest-n < oldest {
 		return oldest, nil
 	}
 
-	return newest + numericOffset, nil
+	return newest - n, nil
+}
+
+// fetchCommittedOffsets fetches the group's committed offsets for the given
+// partitions from its coordinator, without joining the group.
+func fetchCommittedOffsets(client sarama.Client, group string, partitions map[string][]int32) (*sarama.OffsetFetchResponse, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find the coordinator for group %v. err=%v", group, err)
+	}
+
+	req := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			req.AddPartition(topic, p)
+		}
+	}
+	res, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch group %v's offsets. err=%v", group, err)
+	}
+	return res, nil
+}
+
+// keyPartition returns the partition that messages keyed by the key template
+// for fsmId are produced to, given sarama's hash partitioner.
+func keyPartition(key *template.Template, fsmId string, partitions []int32) (int32, error) {
+	if len(partitions) == 0 {
+		return 0, fmt.Errorf("Topic has no partitions")
+	}
+
+	var k bytes.Buffer
+	if err := key.Execute(&k, struct{ FSMId string }{fsmId}); err != nil {
+		return 0, err
+	}
+
+	i, err := sarama.NewHashPartitioner("").Partition(&sarama.ProducerMessage{Key: sarama.ByteEncoder(k.Bytes())}, int32(len(partitions)))
+	if err != nil {
+		return 0, err
+	}
+	return partitions[i], nil
+}
+
+// parseGroupOffset parses offsets like group:<groupId>, or group:<groupId>:-N
+// to start N messages before the group's committed offset.
+func parseGroupOffset(offset string) (string, int64, error) {
+	group, back := strings.TrimPrefix(offset, "group:"), int64(0)
+	if i := strings.LastIndex(group, ":"); i >= 0 {
+		n, err := strconv.ParseInt(group[i+1:], 10, 64)
+		if err != nil || n > 0 {
+			return "", 0, fmt.Errorf("Invalid consumer offset %v; expected group:<groupId>[:-N]", offset)
+		}
+		group, back = group[:i], -n
+	}
+	if group == "" {
+		return "", 0, fmt.Errorf("Invalid consumer offset %v; expected group:<groupId>[:-N]", offset)
+	}
+	return group, back, nil
 }
 
-func joinMessages(pc []<-chan *sarama.ConsumerMessage) chan *sarama.ConsumerMessage {
+// committedOffset fetches the group's committed offset for the partition.
+func committedOffset(client sarama.Client, group string, topic string, partition int32) (int64, error) {
+	res, err := fetchCommittedOffsets(client, group, map[string][]int32{topic: {partition}})
+	if err != nil {
+		return 0, err
+	}
+
+	block := res.GetBlock(topic, partition)
+	if block == nil {
+		return 0, fmt.Errorf("Group %v's offset for %v/%v is missing from the response", group, topic, partition)
+	}
+	if block.Err != sarama.ErrNoError {
+		return 0, fmt.Errorf("Could not fetch group %v's offset for %v/%v. err=%v", group, topic, partition, block.Err)
+	}
+	if block.Offset < 0 {
+		return 0, fmt.Errorf("Group %v has no committed offset for %v/%v", group, topic, partition)
+	}
+	return block.Offset, nil
+}
+
+// joinMessages fans in every channel's messages, and those of every channel
+// later sent on more, until done is closed. The returned channel is closed
+// once every channel is, and more too if given.
+func joinMessages(pc []<-chan *sarama.ConsumerMessage, more <-chan (<-chan *sarama.ConsumerMessage), done <-chan struct{}) chan *sarama.ConsumerMessage {
 	c := make(chan *sarama.ConsumerMessage)
+
+	var wg sync.WaitGroup
+	join := func(p <-chan *sarama.ConsumerMessage) {
+		defer wg.Done()
+		for msg := range p {
+			select {
+			case c <- msg:
+			case <-done:
+				return
+			}
+		}
+	}
+
 	for _, p := range pc {
-		go func(p <-chan *sarama.ConsumerMessage) {
-			for {
-				select {
-				case msg := <-p:
-					c <- msg
-				}
+		wg.Add(1)
+		go join(p)
+	}
+
+	if more != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range more {
+				wg.Add(1)
+				go join(p)
 			}
-		}(p)
+		}()
 	}
+
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
 	return c
 }
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// newMockKafka starts a broker leading every partition of every topic given,
+// each holding n messages with offsets 0 to n-1.
+func newMockKafka(t *testing.T, topics map[string]int32, n int64) *sarama.MockBroker {
+	b := sarama.NewMockBroker(t, 1)
+	b.SetHandlerByMap(mockKafkaHandlers(t, b, topics, n))
+	return b
+}
+
+// TestMain runs the tests speaking the protocol version of sarama's mock
+// broker, which only speaks v0 fetch responses.
+func TestMain(m *testing.M) {
+	saramaVersion = sarama.V0_8_2_0
+	os.Exit(m.Run())
+}
+
+func mockKafkaHandlers(t *testing.T, b *sarama.MockBroker, topics map[string]int32, n int64) map[string]sarama.MockResponse {
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(b.Addr(), b.BrokerID())
+	offsets := sarama.NewMockOffsetResponse(t)
+	fetch := sarama.NewMockFetchResponse(t, 1)
+
+	for topic, partitions := range topics {
+		for p := int32(0); p < partitions; p++ {
+			metadata.SetLeader(topic, p, b.BrokerID())
+			offsets.SetOffset(topic, p, sarama.OffsetOldest, 0).SetOffset(topic, p, sarama.OffsetNewest, n)
+			fetch.SetHighWaterMark(topic, p, n)
+			for o := int64(0); o < n; o++ {
+				fetch.SetMessage(topic, p, o, sarama.StringEncoder(fmt.Sprintf(`{"partition":%v,"offset":%v}`, p, o)))
+			}
+		}
+	}
+
+	return map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"OffsetRequest":   offsets,
+		"FetchRequest":    fetch,
+	}
+}
+
+func TestSetupClusterBoundsReplayByBookieOffsets(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 3}, 10)
+	defer b.Close()
+
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: -1, offset: "newest"}},
+	}
+	f := fsm{Id: "fsm", Topics: map[string]topic{"t": {Count: 2, Partitions: map[string]partition{"1": {Start: 2, End: 4, Count: 2}}}}}
+
+	c := setupCluster(conf, f, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+	if len(c.chs) != 1 {
+		t.Fatalf("expected to consume only the partition the FSM touched; got %v channels", len(c.chs))
+	}
+
+	msgs := joinMessages(c.chs, nil, c.closed)
+	for _, expected := range []int64{2, 3, 4} {
+		select {
+		case msg := <-msgs:
+			if msg.Partition != 1 || msg.Offset != expected {
+				t.Errorf("expected partition 1 offset %v; got partition %v offset %v", expected, msg.Partition, msg.Offset)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for offset %v", expected)
+		}
+	}
+
+	select {
+	case msg, ok := <-msgs:
+		if ok {
+			t.Errorf("expected consumption to stop at Bookie's end offset; got offset %v", msg.Offset)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected messages to be closed once every partition was done")
+	}
+
+	consumed, expected, count, done, total := c.replaySummary()
+	if consumed != 3 || expected != 3 || count != 2 || done != 1 || total != 1 {
+		t.Errorf("unexpected replay summary: consumed=%v expected=%v count=%v done=%v total=%v", consumed, expected, count, done, total)
+	}
+	if len(c.partitionConsumers) != 0 {
+		t.Errorf("expected the finished partition consumer to be closed; %v still open", len(c.partitionConsumers))
+	}
+}
+
+func TestSetupClusterDoesntBoundReplayWithoutBookieEndOffsets(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 3}, 10)
+	defer b.Close()
+
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: -1, offset: "newest"}},
+	}
+	f := fsm{Id: "fsm", Topics: map[string]topic{"t": {Partitions: map[string]partition{"1": {Start: 7}}}}}
+
+	c := setupCluster(conf, f, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+	if len(c.chs) != 1 {
+		t.Fatalf("expected to consume the partition the FSM touched; got %v channels", len(c.chs))
+	}
+
+	msgs := joinMessages(c.chs, nil, c.closed)
+	for _, expected := range []int64{7, 8, 9} {
+		select {
+		case msg := <-msgs:
+			if msg.Partition != 1 || msg.Offset != expected {
+				t.Errorf("expected partition 1 offset %v; got partition %v offset %v", expected, msg.Partition, msg.Offset)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for offset %v", expected)
+		}
+	}
+	if _, _, _, _, total := c.replaySummary(); total != 0 {
+		t.Errorf("expected no bounded replays; got %v", total)
+	}
+}
+
+func TestPartitionStatsReportLagAndRate(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 1}, 10)
+	defer b.Close()
+
+	conf := &config{
+		name:      "config-example",
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: -1, offset: "oldest"}},
+	}
+	c := setupCluster(conf, fsm{}, "s1", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+
+	msgs := c.chs[0] // read directly, so that no fan-in goroutine holds on to a 4th message
+	for i := 0; i < 3; i++ {
+		select {
+		case <-msgs:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for messages")
+		}
+	}
+
+	var stats []partitionStat
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if stats = c.partitionStats(time.Second); len(stats) == 1 && stats[0].Lag == 7 {
+			break
+		}
+	}
+
+	if len(stats) != 1 || stats[0].Topic != "t" || stats[0].Partition != 0 || stats[0].Lag != 7 || stats[0].LastMessage == nil {
+		t.Fatalf("expected a lag of 7 on t/0 after consuming 3 of 10 messages; got %+v", stats)
+	}
+	if stats[0].Rate <= 0 || stats[0].Rate > 3 {
+		t.Errorf("expected a rate of up to 3 messages per second; got %v", stats[0].Rate)
+	}
+	if stats = c.partitionStats(time.Second); stats[0].Rate != 0 {
+		t.Errorf("expected no throughput since the last report; got %v", stats[0].Rate)
+	}
+
+	lag := `flowbro_consumer_lag{config="config-example",session="s1",topic="t",partition="0"}`
+	if g, ok := metricsRegistry.Get(lag).(metrics.Gauge); !ok || g.Value() != 7 {
+		t.Errorf("expected %v to be 7; got %v", lag, metricsRegistry.Get(lag))
+	}
+	c.close()
+	if g := metricsRegistry.Get(lag); g != nil {
+		t.Errorf("expected %v to be gone once the cluster is closed; got %v", lag, g)
+	}
+}
+
+func TestPartitionConsumerIsRecreatedAfterDying(t *testing.T) {
+	oldBackoff := consumerRetryBackoff
+	defer func() { consumerRetryBackoff = oldBackoff }()
+	consumerRetryBackoff = 10 * time.Millisecond
+
+	b := sarama.NewMockBroker(t, 1)
+	defer b.Close()
+	handlers := mockKafkaHandlers(t, b, map[string]int32{"t": 1}, 3)
+
+	outOfRange := &sarama.FetchResponse{}
+	outOfRange.AddError("t", 0, sarama.ErrOffsetOutOfRange)
+	handlers["FetchRequest"] = sarama.NewMockSequence(outOfRange, handlers["FetchRequest"])
+	b.SetHandlerByMap(handlers)
+
+	errs := make(chan error, 10)
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: 0, offset: "oldest"}},
+	}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+
+	msgs := joinMessages(c.chs, nil, c.closed)
+	for _, expected := range []int64{0, 1, 2} {
+		select {
+		case msg := <-msgs:
+			if msg.Offset != expected {
+				t.Errorf("expected offset %v; got %v", expected, msg.Offset)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for offset %v from the re-created partition consumer", expected)
+		}
+	}
+
+	select {
+	case err := <-errs:
+		if cerr, ok := err.(*sarama.ConsumerError); !ok || cerr.Err != sarama.ErrOffsetOutOfRange {
+			t.Errorf("expected the out of range error to be reported; got %v", err)
+		}
+	default:
+		t.Error("expected the consumer error to be reported")
+	}
+
+	c.close()
+	select {
+	case _, ok := <-msgs:
+		if ok {
+			t.Error("expected no more messages after closing the cluster")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected messages to be closed after closing the cluster")
+	}
+}
+
+func TestAddConsumerUsesListedPartitionsAndTheirOffsets(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 4}, 10)
+	defer b.Close()
+
+	conf := &config{
+		brokers: []string{b.Addr()},
+		consumers: []consumerConfig{{
+			brokers:    []string{b.Addr()},
+			topic:      "t",
+			partition:  -1,
+			partitions: []int32{1, 3},
+			offset:     "newest",
+			offsets:    map[int32]string{1: "2", 3: "-3"},
+		}},
+	}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+	if len(c.chs) != 2 {
+		t.Fatalf("expected to consume only the 2 listed partitions; got %v channels", len(c.chs))
+	}
+
+	firsts := map[int32]int64{}
+	msgs := joinMessages(c.chs, nil, c.closed)
+	for len(firsts) < 2 {
+		select {
+		case msg := <-msgs:
+			if _, ok := firsts[msg.Partition]; !ok {
+				firsts[msg.Partition] = msg.Offset
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for messages; got %v", firsts)
+		}
+	}
+
+	expected := map[int32]int64{1: 2, 3: 7}
+	if !reflect.DeepEqual(firsts, expected) {
+		t.Errorf("expected first offsets %v; got %v", expected, firsts)
+	}
+}
+
+func TestAddConsumerFailsOnUnknownListedPartition(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 2}, 1)
+	defer b.Close()
+
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: -1, partitions: []int32{5}, offset: "newest"}},
+	}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) == 0 {
+		t.Error("expected an error for a partition the topic doesn't have")
+	}
+}
+
+func TestAddConsumerStartsFromGroupOffsets(t *testing.T) {
+	b := sarama.NewMockBroker(t, 1)
+	defer b.Close()
+	handlers := mockKafkaHandlers(t, b, map[string]int32{"t": 2}, 10)
+	handlers["ConsumerMetadataRequest"] = sarama.NewMockConsumerMetadataResponse(t).SetCoordinator("svc", b)
+	handlers["OffsetFetchRequest"] = sarama.NewMockOffsetFetchResponse(t).
+		SetOffset("svc", "t", 0, 6, "", sarama.ErrNoError).
+		SetOffset("svc", "t", 1, 1, "", sarama.ErrNoError)
+	b.SetHandlerByMap(handlers)
+
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: -1, offset: "group:svc:-3"}},
+	}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+
+	firsts := map[int32]int64{}
+	msgs := joinMessages(c.chs, nil, c.closed)
+	for len(firsts) < 2 {
+		select {
+		case msg := <-msgs:
+			if _, ok := firsts[msg.Partition]; !ok {
+				firsts[msg.Partition] = msg.Offset
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for messages; got %v", firsts)
+		}
+	}
+
+	expected := map[int32]int64{0: 3, 1: 0} // partition 1's is clamped to the oldest
+	if !reflect.DeepEqual(firsts, expected) {
+		t.Errorf("expected first offsets %v; got %v", expected, firsts)
+	}
+}
+
+func TestAddConsumerFailsWithoutCommittedGroupOffset(t *testing.T) {
+	b := sarama.NewMockBroker(t, 1)
+	defer b.Close()
+	handlers := mockKafkaHandlers(t, b, map[string]int32{"t": 1}, 10)
+	handlers["ConsumerMetadataRequest"] = sarama.NewMockConsumerMetadataResponse(t).SetCoordinator("svc", b)
+	handlers["OffsetFetchRequest"] = sarama.NewMockOffsetFetchResponse(t).SetOffset("svc", "t", 0, -1, "", sarama.ErrNoError)
+	b.SetHandlerByMap(handlers)
+
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: -1, offset: "group:svc"}},
+	}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) == 0 {
+		t.Error("expected an error for a partition the group never committed to")
+	}
+}
+
+func TestGroupLag(t *testing.T) {
+	b := sarama.NewMockBroker(t, 1)
+	defer b.Close()
+	handlers := mockKafkaHandlers(t, b, map[string]int32{"a": 2, "b": 1}, 10)
+	handlers["ConsumerMetadataRequest"] = sarama.NewMockConsumerMetadataResponse(t).SetCoordinator("svc", b)
+	handlers["OffsetFetchRequest"] = sarama.NewMockOffsetFetchResponse(t).
+		SetOffset("svc", "a", 0, 4, "", sarama.ErrNoError).
+		SetOffset("svc", "a", 1, 10, "", sarama.ErrNoError).
+		SetOffset("svc", "b", 0, -1, "", sarama.ErrNoError)
+	b.SetHandlerByMap(handlers)
+
+	client, err := sarama.NewClient([]string{b.Addr()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	lags, err := groupLag(client, "svc", []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	expected := []topicLag{{Topic: "a", Lag: 6, Partitions: 2}, {Topic: "b", Partitions: 1, Uncommitted: 1}}
+	if !reflect.DeepEqual(lags, expected) {
+		t.Errorf("expected %v; got %v", expected, lags)
+	}
+}
+
+func TestAddConsumerOnlyConsumesTheFSMsKeyedPartition(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 4}, 3)
+	defer b.Close()
+
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		fsmId:     "fsm-42",
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topic: "t", partition: -1, offset: "oldest", key: template.Must(template.New("key").Parse("order-{{.FSMId}}"))}},
+	}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+	if len(c.chs) != 1 {
+		t.Fatalf("expected to consume only the FSM's partition; got %v channels", len(c.chs))
+	}
+
+	expected, _ := sarama.NewHashPartitioner("t").Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder("order-fsm-42")}, 4)
+	select {
+	case msg := <-c.chs[0]:
+		if msg.Partition != expected {
+			t.Errorf("expected to consume partition %v; got %v", expected, msg.Partition)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+}
+
+func TestFollowPicksUpNewTopicsAndPartitions(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"orders.a": 1, "other": 1}, 2)
+	defer b.Close()
+
+	conf := &config{
+		brokers:   []string{b.Addr()},
+		consumers: []consumerConfig{{brokers: []string{b.Addr()}, topicRegex: regexp.MustCompile(`^orders\.`), partition: -1, offset: "oldest"}},
+	}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), nil)
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+	if len(c.chs) != 1 {
+		t.Fatalf("expected to consume only orders.a's partition; got %v channels", len(c.chs))
+	}
+
+	notices := make(chan string, 10)
+	c.follow(20*time.Millisecond, func(n string) { notices <- n })
+	msgs := joinMessages(c.chs, c.more, c.closed)
+
+	b.SetHandlerByMap(mockKafkaHandlers(t, b, map[string]int32{"orders.a": 2, "orders.b": 1, "other": 1}, 2))
+
+	consumed := map[string]int{}
+	for i := 0; i < 6; i++ {
+		select {
+		case msg := <-msgs:
+			consumed[fmt.Sprintf("%v/%v", msg.Topic, msg.Partition)]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for messages; got %v", consumed)
+		}
+	}
+	expected := map[string]int{"orders.a/0": 2, "orders.a/1": 2, "orders.b/0": 2}
+	if !reflect.DeepEqual(consumed, expected) {
+		t.Errorf("expected %v; got %v", expected, consumed)
+	}
+
+	if len(notices) != 2 {
+		t.Errorf("expected a notice for each of the 2 new partitions; got %v", len(notices))
+	}
+}
+
+func TestAddNewPartitionsRetriesPartitionsItFailedToConsume(t *testing.T) {
+	b := sarama.NewMockBroker(t, 1)
+	defer b.Close()
+	handlers := mockKafkaHandlers(t, b, map[string]int32{"t": 1}, 2)
+	b.SetHandlerByMap(handlers)
+
+	conf := &config{brokers: []string{b.Addr()}}
+	c := setupCluster(conf, fsm{}, "", log.NewEntry(log.StandardLogger()), func(error) {})
+	defer c.close()
+	if len(c.es.errors) > 0 {
+		t.Fatalf("shouldn't have failed, but did with %v", c.es.errors)
+	}
+
+	failed := &sarama.OffsetResponse{}
+	failed.AddTopicPartition("t", 0, 0)
+	failed.Blocks["t"][0].Err = sarama.ErrNotLeaderForPartition
+	handlers["OffsetRequest"] = sarama.NewMockSequence(failed, failed, handlers["OffsetRequest"]) // the client retries once
+	b.SetHandlerByMap(handlers)
+
+	follow := consumerConfig{brokers: []string{b.Addr()}, topic: "t", partition: -1, offset: "oldest"}
+	if chs := c.addNewPartitions(follow, func(string) {}); len(chs) != 0 {
+		t.Fatalf("expected the first attempt to fail; got %v channels", len(chs))
+	}
+	if chs := c.addNewPartitions(follow, func(string) {}); len(chs) != 1 {
+		t.Errorf("expected the partition to be retried and consumed; got %v channels", len(chs))
+	}
+}
+
+func TestJoinMessagesClosesOnceEveryChannelIs(t *testing.T) {
+	a, b := make(chan *sarama.ConsumerMessage), make(chan *sarama.ConsumerMessage)
+	c := joinMessages([]<-chan *sarama.ConsumerMessage{a, b}, nil, make(chan struct{}))
+
+	go func() {
+		a <- &sarama.ConsumerMessage{Offset: 1}
+		close(a)
+		close(b)
+	}()
+
+	if msg := <-c; msg == nil || msg.Offset != 1 {
+		t.Errorf("expected the message at offset 1; got %v", msg)
+	}
+	if _, ok := <-c; ok {
+		t.Error("expected joined messages to be closed")
+	}
+}
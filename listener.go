@@ -1,8 +1,9 @@
 package main
 
 import (
-	"log"
 	"net"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 func mustGetListener(port int) *net.TCPListener {
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	logLevel  = flag.String("log-level", "info", "minimum level to log: debug, info, warning, error, fatal or panic")
+	logFormat = flag.String("log-format", "text", "log format: text or json")
+)
+
+func setupLogging(level, format string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Invalid log format %v; must be text or json", format)
+	}
+
+	log.SetLevel(l)
+	return nil
+}
@@ -3,22 +3,76 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/profile"
 )
 
 var cpuprofile = flag.Bool("cpuprofile", false, "write cpu profile to file")
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "test-rules" {
+		os.Exit(testRules(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "peek" {
+		os.Exit(peekCommand(os.Args[2:]))
+	}
+
 	flag.Parse()
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		log.Fatalf("Could not set up logging. err=%v", err)
+	}
 	if *cpuprofile {
 		defer profile.Start().Stop()
 	}
 
 	port := 41234
 	listener := mustGetListener(port)
-	baseTemplate := mustParseBasePageTemplate()
+	baseTemplate, templateErr := parseBasePageTemplate()
+	if templateErr != nil {
+		log.WithFields(log.Fields{"err": templateErr}).Error("Could not parse base page template; /healthz will fail.")
+	}
 
+	f := &flowbro{}
+	if *indexConfigPath != "" {
+		f.index = mustStartIndexer(*indexConfigPath)
+		defer f.index.close()
+	}
+
+	srv := f.server(baseTemplate, templateErr)
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Flowbro server went down. err=%v", err)
+		}
+	}()
 	fmt.Printf("Flowbro is your bro on localhost:%v!\n", port)
-	serve(&flowbro{}, baseTemplate, listener)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if err := f.shutdown(srv, *shutdownTimeout); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Exiting without closing every session.")
+	}
+}
+
+func mustStartIndexer(path string) *indexer {
+	conf, err := loadIndexerConfig(path)
+	if err != nil {
+		log.Fatalf("Could not load indexer config %v. err=%v", path, err)
+	}
+
+	idx, err := newIndexer(conf)
+	if err != nil {
+		log.Fatalf("Could not create indexer. err=%v", err)
+	}
+
+	if err := idx.start(); err != nil {
+		log.Fatalf("Could not start indexer. err=%v", err)
+	}
+	return idx
 }
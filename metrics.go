@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// metricsRegistry holds flowbro's own metrics, served in Prometheus' text
+// format on /metrics. go-metrics has no notion of labels, so they're baked
+// into the registered name, e.g. flowbro_consumed_messages_total{topic="a"}.
+var metricsRegistry = metrics.NewRegistry()
+
+var (
+	activeSessions    = counter("flowbro_sessions_active")
+	bufferedMessages  = counter("flowbro_buffered_messages")
+	eventsSent        = counter("flowbro_events_sent_total")
+	sendErrors        = counter("flowbro_send_errors_total")
+	heartbeatTimeouts = counter("flowbro_heartbeat_timeouts_total")
+	grepFiltered      = counter("flowbro_grep_filtered_messages_total")
+)
+
+// maxSeries caps how many label combinations a metric gets; label values
+// such as topics come from what clients send, and counters are never
+// unregistered, so past the cap they're all counted as "other".
+const maxSeries = 500
+
+var series = struct {
+	sync.Mutex
+	names map[string]map[string]bool
+}{names: map[string]map[string]bool{}}
+
+// counter returns the counter for name and the given label/value pairs.
+// Counters whose name doesn't end in _total are exposed as gauges, as they
+// go down as well as up.
+func counter(name string, labels ...string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(limitedMetricName(name, labels...), metricsRegistry)
+}
+
+func gauge(name string, labels ...string) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(limitedMetricName(name, labels...), metricsRegistry)
+}
+
+func limitedMetricName(name string, labels ...string) string {
+	full := metricName(name, labels...)
+
+	series.Lock()
+	defer series.Unlock()
+	if series.names[name] == nil {
+		series.names[name] = map[string]bool{}
+	}
+	if !series.names[name][full] && len(series.names[name]) >= maxSeries {
+		other := append([]string{}, labels...)
+		for i := 1; i < len(other); i += 2 {
+			other[i] = "other"
+		}
+		full = metricName(name, other...)
+	}
+	series.names[name][full] = true
+	return full
+}
+
+// labelEscaper escapes label values as Prometheus' text format expects.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricName(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricConfig is the config name to label metrics with: the name of one of
+// the configs on disk, or "other" for configs clients made up.
+func metricConfig(name string) string {
+	path, err := resolvePath(mainPath, name+".json")
+	if err != nil || name == "" {
+		return "other"
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "other"
+	}
+	return name
+}
+
+func countConsumed(cm *sarama.ConsumerMessage) {
+	counter("flowbro_consumed_messages_total", "topic", cm.Topic).Inc(1)
+	counter("flowbro_consumed_bytes_total", "topic", cm.Topic).Inc(int64(len(cm.Key) + len(cm.Value)))
+}
+
+// recordLag updates the partition's lag given the message just consumed from it.
+func recordLag(pc sarama.PartitionConsumer, cm *sarama.ConsumerMessage, labels []string) {
+	lag := pc.HighWaterMarkOffset() - cm.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	metrics.GetOrRegisterGauge(lagMetricName(cm.Topic, cm.Partition, labels), metricsRegistry).Update(lag)
+}
+
+// forgetLag drops the partition's lag, e.g. once the session consuming it ends.
+func forgetLag(topic string, partition int32, labels []string) {
+	metricsRegistry.Unregister(lagMetricName(topic, partition, labels))
+}
+
+func lagMetricName(topic string, partition int32, labels []string) string {
+	return metricName("flowbro_consumer_lag", append(append([]string{}, labels...), "topic", topic, "partition", fmt.Sprint(partition))...)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, metricsRegistry)
+}
+
+func writeMetrics(w io.Writer, r metrics.Registry) {
+	samples := map[string][]string{}
+	types := map[string]string{}
+	r.Each(func(name string, i interface{}) {
+		base := name
+		if i := strings.Index(name, "{"); i >= 0 {
+			base = name[:i]
+		}
+
+		switch m := i.(type) {
+		case metrics.Counter:
+			types[base] = "gauge"
+			if strings.HasSuffix(base, "_total") {
+				types[base] = "counter"
+			}
+			samples[base] = append(samples[base], fmt.Sprintf("%v %v", name, m.Count()))
+		case metrics.Gauge:
+			types[base] = "gauge"
+			samples[base] = append(samples[base], fmt.Sprintf("%v %v", name, m.Value()))
+		}
+	})
+
+	bases := []string{}
+	for base := range samples {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	for _, base := range bases {
+		sort.Strings(samples[base])
+		fmt.Fprintf(w, "# TYPE %v %v\n", base, types[base])
+		for _, s := range samples[base] {
+			fmt.Fprintln(w, s)
+		}
+	}
+}
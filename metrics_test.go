@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestWriteMetricsInPrometheusTextFormat(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter(metricName("flowbro_consumed_messages_total", "topic", "b"), r).Inc(2)
+	metrics.GetOrRegisterCounter(metricName("flowbro_consumed_messages_total", "topic", "a"), r).Inc(5)
+	metrics.GetOrRegisterCounter(metricName("flowbro_sessions_active"), r).Inc(1)
+	metrics.GetOrRegisterGauge(metricName("flowbro_consumer_lag", "topic", "a", "partition", "0"), r).Update(42)
+
+	var b bytes.Buffer
+	writeMetrics(&b, r)
+
+	expected := `# TYPE flowbro_consumed_messages_total counter
+flowbro_consumed_messages_total{topic="a"} 5
+flowbro_consumed_messages_total{topic="b"} 2
+# TYPE flowbro_consumer_lag gauge
+flowbro_consumer_lag{topic="a",partition="0"} 42
+# TYPE flowbro_sessions_active gauge
+flowbro_sessions_active 1
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%v\nbut got:\n%v", expected, b.String())
+	}
+}
+
+func TestRuleMatchesAreCounted(t *testing.T) {
+	before := counter("flowbro_rule_matches_total", "config", "orders", "rule", "1").Count()
+
+	rules := []rule{
+		{Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "nope"}}},
+		{Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "topic"}}},
+	}
+	if err := processMessage(message{Topic: "topic"}, "orders", rules, map[string]string{}, &[]event{}, &[]event{}, ""); err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	if after := counter("flowbro_rule_matches_total", "config", "orders", "rule", "1").Count(); after != before+1 {
+		t.Errorf("expected rule 1's matches to go from %v to %v; got %v", before, before+1, after)
+	}
+}
+
+func TestMetricNameEscapesLabelValues(t *testing.T) {
+	actual := metricName("m", "topic", "a\\b\"c\ndé")
+	if expected := "m{topic=\"a\\\\b\\\"c\\ndé\"}"; actual != expected {
+		t.Errorf("expected %v; got %v", expected, actual)
+	}
+}
+
+func TestMetricSeriesAreCapped(t *testing.T) {
+	for i := 0; i < maxSeries+10; i++ {
+		counter("flowbro_test_capped_total", "topic", strconv.Itoa(i)).Inc(1)
+	}
+
+	if c := counter("flowbro_test_capped_total", "topic", "0").Count(); c != 1 {
+		t.Errorf("expected series under the cap to be kept; got %v", c)
+	}
+	if c := counter("flowbro_test_capped_total", "topic", "new").Count(); c != 10 {
+		t.Errorf("expected series over the cap to be counted as other; got %v", c)
+	}
+}
+
+func TestMetricConfig(t *testing.T) {
+	ts := []struct {
+		name     string
+		expected string
+	}{
+		{name: "config-example", expected: "config-example"},
+		{name: "made-up", expected: "other"},
+		{name: "../configs/config-example", expected: "other"},
+		{name: "", expected: "other"},
+	}
+
+	for _, tc := range ts {
+		if actual := metricConfig(tc.name); actual != tc.expected {
+			t.Errorf("expected %q for %q; got %q", tc.expected, tc.name, actual)
+		}
+	}
+}
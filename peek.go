@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+var peekTimeout = flag.Duration("peek-timeout", 5*time.Second, "how long /api/peek and /api/message wait for messages")
+
+const maxPeek = 100
+
+// peekResult is a sample of a topic's latest messages, to help with writing
+// rules for it.
+type peekResult struct {
+	Topic       string        `json:"topic"`
+	Messages    []message     `json:"messages"`
+	Unparseable int           `json:"unparseable,omitempty"` // messages that weren't JSON
+	Schema      []schemaField `json:"schema"`
+}
+
+// schemaField describes a path into the sampled messages, in template syntax
+// except that [] stands for any element of an array.
+type schemaField struct {
+	Path    string      `json:"path"`
+	Types   []string    `json:"types"`
+	Count   int         `json:"count"` // sampled messages it's in
+	Example interface{} `json:"example,omitempty"`
+}
+
+// peek fetches the last n messages of every partition of the topic, or as
+// many as it can until the timeout.
+func peek(brokers []string, topic string, n int64, timeout time.Duration) (peekResult, error) {
+	result := peekResult{Topic: topic, Messages: []message{}, Schema: []schemaField{}}
+
+	client, consumer, err := newPeekConsumer(brokers)
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+	defer consumer.Close()
+
+	partitions, err := resolvePartitions(topic, -1, nil, consumer)
+	if err != nil {
+		return result, err
+	}
+
+	var l sync.Mutex
+	var wg sync.WaitGroup
+	cms, errs := []*sarama.ConsumerMessage{}, []string{}
+	done := make(chan struct{}) // closed, rather than sent on, so that every partition sees it
+	timer := time.AfterFunc(timeout, func() { close(done) })
+	defer timer.Stop()
+	for _, partition := range partitions {
+		wg.Add(1)
+		go func(partition int32) {
+			defer wg.Done()
+			pcms, err := peekPartition(client, consumer, topic, partition, n, done)
+			l.Lock()
+			defer l.Unlock()
+			cms = append(cms, pcms...)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}(partition)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return result, fmt.Errorf("Could not peek at every partition of %v. errs=%v", topic, errs)
+	}
+
+	sort.Slice(cms, func(i, j int) bool {
+		if cms[i].Partition != cms[j].Partition {
+			return cms[i].Partition < cms[j].Partition
+		}
+		return cms[i].Offset < cms[j].Offset
+	})
+	for _, cm := range cms {
+		m, err := newMessage(*cm)
+		if err != nil {
+			result.Unparseable++
+			continue
+		}
+		result.Messages = append(result.Messages, m)
+	}
+	result.Schema = inferSchema(result.Messages)
+	return result, nil
+}
+
+func newPeekConsumer(brokers []string) (sarama.Client, sarama.Consumer, error) {
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = saramaVersion
+	client, err := sarama.NewClient(brokers, saramaConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating client. err=%v", err)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("Error creating consumer. err=%v", err)
+	}
+	return client, consumer, nil
+}
+
+func peekPartition(client sarama.Client, consumer sarama.Consumer, topic string, partition int32, n int64, done <-chan struct{}) ([]*sarama.ConsumerMessage, error) {
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, err
+	}
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := lastOffset(client, topic, partition, n, oldest)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= newest {
+		return nil, nil
+	}
+
+	pc, err := consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	cms := []*sarama.ConsumerMessage{}
+	for {
+		select {
+		case cm, ok := <-pc.Messages():
+			if !ok {
+				return cms, fmt.Errorf("Partition consumer for %v/%v died", topic, partition)
+			}
+			cms = append(cms, cm)
+			if cm.Offset >= newest-1 {
+				return cms, nil
+			}
+		case <-done:
+			return cms, nil
+		}
+	}
+}
+
+// inferSchema lists every path into the messages' values, with the types and
+// an example value seen at each.
+func inferSchema(ms []message) []schemaField {
+	fields := map[string]*schemaField{}
+	for _, m := range ms {
+		seen := map[string]bool{}
+		note := func(path string, typ string, v interface{}) {
+			f, ok := fields[path]
+			if !ok {
+				f = &schemaField{Path: path, Types: []string{}}
+				fields[path] = f
+			}
+			if !seen[path] {
+				f.Count++
+				seen[path] = true
+			}
+			if !contains(f.Types, typ) {
+				f.Types = append(f.Types, typ)
+				sort.Strings(f.Types)
+			}
+			if f.Example == nil && typ != "object" && typ != "array" {
+				f.Example = v
+			}
+		}
+
+		if m.IsTombstone {
+			note(".Value", "tombstone", nil)
+			continue
+		}
+		walkValue(".Value", m.Value, note)
+	}
+
+	schema := []schemaField{}
+	for _, f := range fields {
+		schema = append(schema, *f)
+	}
+	sort.Slice(schema, func(i, j int) bool { return schema[i].Path < schema[j].Path })
+	return schema
+}
+
+func walkValue(path string, v interface{}, note func(string, string, interface{})) {
+	note(path, jsonType(v), v)
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, fv := range v {
+			walkValue(path+"."+k, fv, note)
+		}
+	case []interface{}:
+		for _, ev := range v {
+			walkValue(path+"[]", ev, note)
+		}
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePeekQuery(brokers string, topic string, n string) ([]string, int64, error) {
+	if brokers == "" || topic == "" {
+		return nil, 0, fmt.Errorf("Please give brokers and topic")
+	}
+
+	count := int64(5)
+	if n != "" {
+		var err error
+		if count, err = strconv.ParseInt(n, 10, 64); err != nil || count < 1 || count > maxPeek {
+			return nil, 0, fmt.Errorf("Invalid n %v; expected 1 to %v", n, maxPeek)
+		}
+	}
+	return strings.Split(brokers, ","), count, nil
+}
+
+func peekHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	brokers, n, err := parsePeekQuery(q.Get("brokers"), q.Get("topic"), q.Get("n"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := peek(brokers, q.Get("topic"), n, *peekTimeout)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Peeking failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func peekCommand(args []string) int {
+	fs := flag.NewFlagSet("peek", flag.ExitOnError)
+	brokers := fs.String("brokers", "", "comma separated brokers")
+	topic := fs.String("topic", "", "topic to peek at")
+	n := fs.String("n", "5", "how many of the last messages to fetch per partition")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for the messages")
+	schemaOnly := fs.Bool("schema", false, "only print the inferred schema")
+	fs.Parse(args)
+
+	brokerList, count, err := parsePeekQuery(*brokers, *topic, *n)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Usage: flowbro peek --brokers localhost:9092 --topic orders [--n 5] [--schema]")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	result, err := peek(brokerList, *topic, count, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var v interface{} = result
+	if *schemaOnly {
+		v = result.Schema
+	}
+	byt, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while marshalling peeked messages: err=%v\n", err)
+		return 1
+	}
+	os.Stdout.Write(append(byt, '\n'))
+	return 0
+}
+
+// errMessageNotFound is returned for coordinates that aren't on Kafka, e.g.
+// because retention already deleted the message.
+var errMessageNotFound = fmt.Errorf("Message not found")
+
+// fetchMessage fetches and decodes the single message at the coordinates.
+func fetchMessage(brokers []string, ref messageRef, timeout time.Duration) (message, error) {
+	client, consumer, err := newPeekConsumer(brokers)
+	if err != nil {
+		return message{}, err
+	}
+	defer client.Close()
+	defer consumer.Close()
+
+	oldest, err := client.GetOffset(ref.Topic, ref.Partition, sarama.OffsetOldest)
+	if err != nil {
+		return message{}, err
+	}
+	newest, err := client.GetOffset(ref.Topic, ref.Partition, sarama.OffsetNewest)
+	if err != nil {
+		return message{}, err
+	}
+	if ref.Offset < oldest || ref.Offset >= newest {
+		return message{}, errMessageNotFound
+	}
+
+	pc, err := consumer.ConsumePartition(ref.Topic, ref.Partition, ref.Offset)
+	if err != nil {
+		return message{}, err
+	}
+	defer pc.Close()
+
+	select {
+	case cm, ok := <-pc.Messages():
+		if !ok || cm.Offset != ref.Offset { // e.g. compacted away
+			return message{}, errMessageNotFound
+		}
+		return newMessage(*cm)
+	case <-time.After(timeout):
+		return message{}, fmt.Errorf("Timed out fetching %v/%v/%v", ref.Topic, ref.Partition, ref.Offset)
+	}
+}
+
+func messageHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	partition, perr := strconv.ParseInt(q.Get("partition"), 10, 32)
+	offset, oerr := strconv.ParseInt(q.Get("offset"), 10, 64)
+	if q.Get("brokers") == "" || q.Get("topic") == "" || perr != nil || oerr != nil {
+		http.Error(w, "Please give brokers, topic, partition and offset", http.StatusBadRequest)
+		return
+	}
+
+	ref := messageRef{Topic: q.Get("topic"), Partition: int32(partition), Offset: offset}
+	m, err := fetchMessage(strings.Split(q.Get("brokers"), ","), ref, *peekTimeout)
+	if err == errMessageNotFound {
+		http.Error(w, fmt.Sprintf("No message at %v/%v/%v", ref.Topic, ref.Partition, ref.Offset), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Fetching message failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestPeekFetchesTheLastMessagesOfEveryPartition(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 2}, 10)
+	defer b.Close()
+
+	result, err := peek([]string{b.Addr()}, "t", 3, 2*time.Second)
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	actual := [][2]int64{}
+	for _, m := range result.Messages {
+		actual = append(actual, [2]int64{int64(m.Partition), m.Offset})
+	}
+	expected := [][2]int64{{0, 7}, {0, 8}, {0, 9}, {1, 7}, {1, 8}, {1, 9}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected partitions and offsets %v; got %v", expected, actual)
+	}
+
+	expectedSchema := []schemaField{
+		{Path: ".Value", Types: []string{"object"}, Count: 6},
+		{Path: ".Value.offset", Types: []string{"number"}, Count: 6, Example: 7.0},
+		{Path: ".Value.partition", Types: []string{"number"}, Count: 6, Example: 0.0},
+	}
+	if !reflect.DeepEqual(result.Schema, expectedSchema) {
+		t.Errorf("expected schema %+v; got %+v", expectedSchema, result.Schema)
+	}
+}
+
+func TestPeekTimesOutOnEveryPartitionWhoseTailNeverArrives(t *testing.T) {
+	b := sarama.NewMockBroker(t, 1)
+	defer b.Close()
+	handlers := mockKafkaHandlers(t, b, map[string]int32{"t": 3}, 10)
+	fetch := sarama.NewMockFetchResponse(t, 1)
+	for p := int32(0); p < 3; p++ {
+		fetch.SetHighWaterMark("t", p, 10)
+		for o := int64(0); o < 9; o++ { // e.g. offset 9 is a transaction marker
+			fetch.SetMessage("t", p, o, sarama.StringEncoder(fmt.Sprintf(`{"offset":%v}`, o)))
+		}
+	}
+	handlers["FetchRequest"] = fetch
+	b.SetHandlerByMap(handlers)
+
+	type peeked struct {
+		result peekResult
+		err    error
+	}
+	res := make(chan peeked, 1)
+	go func() {
+		result, err := peek([]string{b.Addr()}, "t", 3, 500*time.Millisecond)
+		res <- peeked{result, err}
+	}()
+
+	select {
+	case r := <-res:
+		if r.err != nil {
+			t.Fatalf("shouldn't have failed, but did with %v", r.err)
+		}
+		if len(r.result.Messages) != 6 {
+			t.Errorf("expected offsets 7 and 8 of each partition; got %+v", r.result.Messages)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected peek to give up on every partition after the timeout")
+	}
+}
+
+func TestInferSchema(t *testing.T) {
+	ms := []message{
+		{Value: map[string]interface{}{"id": "a", "items": []interface{}{map[string]interface{}{"sku": "x"}}}},
+		{Value: map[string]interface{}{"id": 1.0, "items": []interface{}{}}},
+		{IsTombstone: true},
+	}
+
+	expected := []schemaField{
+		{Path: ".Value", Types: []string{"object", "tombstone"}, Count: 3},
+		{Path: ".Value.id", Types: []string{"number", "string"}, Count: 2, Example: "a"},
+		{Path: ".Value.items", Types: []string{"array"}, Count: 2},
+		{Path: ".Value.items[]", Types: []string{"object"}, Count: 1},
+		{Path: ".Value.items[].sku", Types: []string{"string"}, Count: 1, Example: "x"},
+	}
+	if actual := inferSchema(ms); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v; got %+v", expected, actual)
+	}
+}
+
+func TestParsePeekQuery(t *testing.T) {
+	ts := []struct {
+		brokers, topic, n string
+		expectedN         int64
+		fails             bool
+	}{
+		{brokers: "a:9092", topic: "t", expectedN: 5},
+		{brokers: "a:9092,b:9092", topic: "t", n: "20", expectedN: 20},
+		{topic: "t", fails: true},
+		{brokers: "a:9092", fails: true},
+		{brokers: "a:9092", topic: "t", n: "0", fails: true},
+		{brokers: "a:9092", topic: "t", n: "101", fails: true},
+		{brokers: "a:9092", topic: "t", n: "many", fails: true},
+	}
+
+	for _, tc := range ts {
+		_, n, err := parsePeekQuery(tc.brokers, tc.topic, tc.n)
+		if tc.fails != (err != nil) {
+			t.Errorf("%+v: expected failure to be %v; got %v", tc, tc.fails, err)
+		}
+		if !tc.fails && n != tc.expectedN {
+			t.Errorf("%+v: expected n to be %v; got %v", tc, tc.expectedN, n)
+		}
+	}
+}
+
+func TestFetchMessage(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 2}, 10)
+	defer b.Close()
+
+	m, err := fetchMessage([]string{b.Addr()}, messageRef{Topic: "t", Partition: 1, Offset: 4}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	expected := map[string]interface{}{"partition": 1.0, "offset": 4.0}
+	if !reflect.DeepEqual(m.Value, expected) || m.Partition != 1 || m.Offset != 4 {
+		t.Errorf("expected t/1/4 with value %v; got %+v", expected, m)
+	}
+
+	if _, err := fetchMessage([]string{b.Addr()}, messageRef{Topic: "t", Partition: 1, Offset: 10}, 2*time.Second); err != errMessageNotFound {
+		t.Errorf("expected offsets past the newest not to be found; got %v", err)
+	}
+}
+
+func TestMessageHandler(t *testing.T) {
+	b := newMockKafka(t, map[string]int32{"t": 1}, 10)
+	defer b.Close()
+
+	ts := []struct {
+		query  string
+		status int
+	}{
+		{query: fmt.Sprintf("brokers=%v&topic=t&partition=0&offset=3", b.Addr()), status: http.StatusOK},
+		{query: fmt.Sprintf("brokers=%v&topic=t&partition=0&offset=42", b.Addr()), status: http.StatusNotFound},
+		{query: fmt.Sprintf("brokers=%v&topic=t&partition=0", b.Addr()), status: http.StatusBadRequest},
+		{query: "topic=t&partition=0&offset=3", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range ts {
+		w := httptest.NewRecorder()
+		messageHandler(w, httptest.NewRequest("GET", "/api/message?"+tc.query, nil))
+		if w.Code != tc.status {
+			t.Errorf("%v: expected status %v; got %v with %v", tc.query, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+var recordingsDir = flag.String("recordings-dir", "recordings", "directory where recorded sessions are stored")
+
+const recordingExt = ".tar.gz"
+
+// recorder persists the raw messages consumed during a session, and
+// optionally the events sent for them, into a compressed archive that can be
+// downloaded and replayed later.
+type recorder struct {
+	id   string
+	dir  string
+	tmp  string
+	done chan struct{}
+	log  *log.Entry
+
+	l        sync.Mutex
+	closed   bool
+	messages *os.File
+	events   *os.File
+}
+
+func newRecorder(dir string, configJSON configJSON, recordEvents bool, logger *log.Entry) (*recorder, error) {
+	id, err := newRecordingId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempDir(dir, "."+id)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{id: id, dir: dir, tmp: tmp, done: make(chan struct{}), log: logger}
+
+	byt, err := json.MarshalIndent(configJSON, "", "  ")
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "config.json"), byt, 0644); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	if r.messages, err = os.Create(filepath.Join(tmp, "messages.jsonl")); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	if recordEvents {
+		if r.events, err = os.Create(filepath.Join(tmp, "events.jsonl")); err != nil {
+			r.messages.Close()
+			os.RemoveAll(tmp)
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func newRecordingId() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b), nil
+}
+
+// tee returns a channel that yields every message from c after recording it.
+func (r *recorder) tee(c chan *sarama.ConsumerMessage) chan *sarama.ConsumerMessage {
+	out := make(chan *sarama.ConsumerMessage)
+	go func() {
+		for {
+			select {
+			case cm, ok := <-c:
+				if !ok {
+					close(out)
+					return
+				}
+				r.recordMessage(cm)
+				select {
+				case out <- cm:
+				case <-r.done:
+					return
+				}
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (r *recorder) recordMessage(cm *sarama.ConsumerMessage) {
+	rm := recordedMessage{
+		Key:       string(cm.Key),
+		Topic:     cm.Topic,
+		Partition: cm.Partition,
+		Offset:    cm.Offset,
+		Timestamp: cm.Timestamp,
+	}
+	if json.Valid(cm.Value) {
+		rm.Value = json.RawMessage(cm.Value)
+	} else if cm.Value != nil {
+		byt, _ := json.Marshal(string(cm.Value))
+		rm.Value, rm.ValueEncoding = json.RawMessage(byt), "raw"
+	}
+
+	byt, err := json.Marshal(rm)
+	if err != nil {
+		r.log.WithFields(log.Fields{"err": err, "recording": r.id}).Error("Could not marshal message for recording.")
+		return
+	}
+	r.write(r.messages, byt)
+}
+
+func (r *recorder) recordEvents(frame string) {
+	if r.events != nil {
+		r.write(r.events, []byte(frame))
+	}
+}
+
+func (r *recorder) write(f *os.File, line []byte) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.closed {
+		return
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		r.log.WithFields(log.Fields{"err": err, "recording": r.id, "file": filepath.Base(f.Name())}).Error("Could not write to recording.")
+	}
+}
+
+// close stops recording and packs everything into the recording's archive.
+func (r *recorder) close() error {
+	r.l.Lock()
+	if r.closed {
+		r.l.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	r.messages.Close()
+	if r.events != nil {
+		r.events.Close()
+	}
+	r.l.Unlock()
+
+	defer os.RemoveAll(r.tmp)
+
+	partial := filepath.Join(r.tmp, r.id+recordingExt)
+	if err := writeArchive(partial, r.tmp); err != nil {
+		return err
+	}
+	return os.Rename(partial, filepath.Join(r.dir, r.id+recordingExt))
+}
+
+func writeArchive(path string, dir string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	for _, name := range []string{"config.json", "messages.jsonl", "events.jsonl"} {
+		if err := addToArchive(tw, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func addToArchive(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// readArchivedMessages reads the messages file out of a recording archive.
+func readArchivedMessages(r io.Reader) ([]*sarama.ConsumerMessage, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Archive has no messages.jsonl")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == "messages.jsonl" {
+			return readRecordedMessages(bufio.NewReader(tr))
+		}
+	}
+}
+
+type recordingSender struct {
+	iSender
+	r *recorder
+}
+
+func (s recordingSender) Send(ws *websocket.Conn, msg string) error {
+	s.r.recordEvents(msg)
+	return s.iSender.Send(ws, msg)
+}
+
+func recordingsHandler(dir string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/recordings/")
+		if name == "" {
+			ids, err := listRecordings(dir)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ids)
+			return
+		}
+
+		if !strings.HasSuffix(name, recordingExt) || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "flowbro-"+name))
+		http.ServeFile(w, r, filepath.Join(dir, name))
+	}
+}
+
+func listRecordings(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), recordingExt) {
+			ids = append(ids, strings.TrimSuffix(info.Name(), recordingExt))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestRecorderRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowbro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := newRecorder(dir, configJSON{FSMId: "123"}, true, log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	ts := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	recorded := []*sarama.ConsumerMessage{
+		{Key: []byte("1"), Value: []byte(`{"target":"phone"}`), Topic: "requests", Partition: 1, Offset: 10, Timestamp: ts},
+		{Key: []byte("2"), Value: []byte(`not json`), Topic: "raw", Partition: 0, Offset: 11, Timestamp: ts},
+		{Key: []byte("3"), Value: nil, Topic: "compacted", Partition: 2, Offset: 12, Timestamp: ts},
+		{Key: []byte("4"), Value: []byte(`"abc"`), Topic: "strings", Partition: 0, Offset: 13, Timestamp: ts},
+		{Key: []byte("5"), Value: []byte(`null`), Topic: "nulls", Partition: 0, Offset: 14, Timestamp: ts},
+		{Key: []byte("6"), Value: []byte("say \"hi\" \\u00e9 \x01"), Topic: "raw", Partition: 0, Offset: 15, Timestamp: ts},
+		{Key: []byte("7"), Value: []byte(`"unterminated`), Topic: "raw", Partition: 0, Offset: 16, Timestamp: ts},
+	}
+
+	in := make(chan *sarama.ConsumerMessage)
+	out := r.tee(in)
+	for _, cm := range recorded {
+		in <- cm
+		if actual := <-out; actual != cm {
+			t.Errorf("expected tee to forward %+v but got %+v", cm, actual)
+		}
+	}
+	r.recordEvents(`[{"eventType":"log"}]`)
+
+	if err := r.close(); err != nil {
+		t.Fatalf("shouldn't have failed closing, but did with %v", err)
+	}
+
+	ids, err := listRecordings(dir)
+	if err != nil || !reflect.DeepEqual(ids, []string{r.id}) {
+		t.Fatalf("expected recordings [%v] but got %v, %v", r.id, ids, err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, r.id+recordingExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	actual, err := readArchivedMessages(f)
+	if err != nil {
+		t.Fatalf("shouldn't have failed reading archive, but did with %v", err)
+	}
+	if len(actual) != len(recorded) {
+		t.Fatalf("expected %v messages but got %v", len(recorded), len(actual))
+	}
+	for i := range recorded {
+		if !reflect.DeepEqual(actual[i], recorded[i]) {
+			t.Errorf("message %v mismatch; expected %+v but got %+v", i, recorded[i], actual[i])
+		}
+	}
+}
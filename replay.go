@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// replayProgress tracks a partition consumer that replays an FSM between the
+// offsets Bookie has for it.
+type replayProgress struct {
+	topic     string
+	partition int32
+	start     int64
+	end       int64
+	count     int64 // messages Bookie attributes to the FSM on the partition
+	consumed  int64
+	done      bool
+}
+
+func (c *cluster) addReplay(rp *replayProgress) {
+	c.replaysLock.Lock()
+	c.replays = append(c.replays, rp)
+	c.replaysLock.Unlock()
+}
+
+// replayed counts msg towards rp, returning whether it was the last one.
+func (c *cluster) replayed(rp *replayProgress, msg *sarama.ConsumerMessage) bool {
+	c.replaysLock.Lock()
+	defer c.replaysLock.Unlock()
+	rp.consumed++
+	rp.done = msg.Offset >= rp.end
+	return rp.done
+}
+
+// replaySummary adds up progress over all bounded partitions: messages
+// consumed, messages in the offset ranges being replayed, messages Bookie
+// attributes to the FSM, and how many partitions are done.
+func (c *cluster) replaySummary() (consumed, expected, count int64, done, total int) {
+	c.replaysLock.Lock()
+	defer c.replaysLock.Unlock()
+
+	for _, rp := range c.replays {
+		consumed += rp.consumed
+		expected += rp.end - rp.start + 1
+		count += rp.count
+		if rp.done {
+			done++
+		}
+	}
+	return consumed, expected, count, done, len(c.replays)
+}
+
+// reportReplayProgress tells the client how far along replaying the FSM is,
+// whenever it changes, until every bounded partition is done.
+func reportReplayProgress(s *session, c *cluster, fsmId string, every time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	var last int64 = -1
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		consumed, expected, count, done, total := c.replaySummary()
+		if total == 0 {
+			return
+		}
+		if done == total {
+			s.sendSuccess(fmt.Sprintf("Finished replaying FSM %v: reached Bookie's last known offset on all %v partitions (%v messages, %v of them counted for the FSM).", fsmId, total, consumed, count))
+			return
+		}
+		if consumed != last {
+			s.sendSuccess(fmt.Sprintf("Replaying FSM %v: %v/%v messages consumed, %v/%v partitions done (Bookie counted %v messages for the FSM).", fsmId, consumed, expected, done, total, count))
+			last = consumed
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// searchHandler serves /api/fsms, which finds FSMs on a config's Bookie and
+// returns links to sessions pre-seeded with their ids. It takes a config name
+// and any of tag=key:value (repeatable), from and to (RFC3339 creation time
+// range), prefix (of the FSM id) and n (max results).
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	config := r.URL.Query().Get("config")
+	q, err := parseFSMQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path, err := resolvePath(mainPath, config+".json")
+	if err != nil || config == "" {
+		http.Error(w, "Invalid config", http.StatusBadRequest)
+		return
+	}
+
+	b, ok := newBookieFromConfigFilePath(path, log.WithFields(log.Fields{"config": config, "remote": r.RemoteAddr}))
+	if !ok {
+		http.Error(w, fmt.Sprintf("Config %v doesn't exist or has no bookieURL", config), http.StatusNotFound)
+		return
+	}
+
+	fsms, err := b.search(q)
+	if err != nil {
+		b.log.WithFields(log.Fields{"err": err, "url": b.url}).Warn("Failed to search FSMs on Bookie.")
+		http.Error(w, fmt.Sprintf("Searching Bookie failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	links := []Link{}
+	for _, f := range fsms {
+		links = append(links, fsmLink(config, f))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+func parseFSMQuery(v url.Values) (fsmQuery, error) {
+	q := fsmQuery{tags: map[string]string{}, prefix: v.Get("prefix"), n: 50}
+
+	for _, tag := range v["tag"] {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return q, fmt.Errorf("Invalid tag %v; use key:value", tag)
+		}
+		q.tags[kv[0]] = kv[1]
+	}
+
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.from}, {"to", &q.to}} {
+		if s := v.Get(t.name); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return q, fmt.Errorf("Invalid %v; use RFC3339 like 2006-01-02T15:04:05Z", t.name)
+			}
+			*t.dst = parsed
+		}
+	}
+	if !q.from.IsZero() && !q.to.IsZero() && q.to.Before(q.from) {
+		return q, fmt.Errorf("Invalid time range; to is before from")
+	}
+
+	if s := v.Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("Invalid n %v", s)
+		}
+		q.n = n
+	}
+
+	return q, nil
+}
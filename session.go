@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// session is a client connected over a WebSocket. Everything logged on its
+// behalf carries its id, the client's address and, once it's known, the name
+// of the config it runs.
+type session struct {
+	id  string
+	ws  *websocket.Conn
+	log *log.Entry
+
+	closing chan struct{} // closed when flowbro wants the session to end
+	once    sync.Once
+}
+
+func newSession(ws *websocket.Conn) *session {
+	id := newSessionId()
+
+	remote := ""
+	if r := ws.Request(); r != nil {
+		remote = r.RemoteAddr
+	}
+
+	return &session{
+		id:      id,
+		ws:      ws,
+		log:     log.WithFields(log.Fields{"session": id, "remote": remote}),
+		closing: make(chan struct{}),
+	}
+}
+
+// stop asks the session to end; safe to call more than once.
+func (s *session) stop() {
+	s.once.Do(func() { close(s.closing) })
+}
+
+func newSessionId() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *session) sendError(text string) {
+	s.log.Warn(text)
+	s.send(event{EventType: "log", Text: text, Color: "error"})
+}
+
+func (s *session) sendSuccess(text string) {
+	s.log.Info(text)
+	s.send(event{EventType: "log", Text: text, Color: "happy"})
+}
+
+func (s *session) send(events ...event) error {
+	byt, err := json.Marshal(events)
+	if err != nil {
+		s.log.WithFields(log.Fields{"err": err}).Error("Error while marshalling events.")
+		return err
+	}
+	return websocket.Message.Send(s.ws, string(byt))
+}
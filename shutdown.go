@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for sessions to close on SIGINT or SIGTERM before exiting anyway")
+
+// register tracks a new session, unless flowbro is shutting down.
+func (f *flowbro) register(s *session) bool {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if f.closing {
+		return false
+	}
+
+	if f.sessions == nil {
+		f.sessions = map[string]*session{}
+	}
+	f.sessions[s.id] = s
+	f.wg.Add(1)
+	return true
+}
+
+func (f *flowbro) unregister(s *session) {
+	f.l.Lock()
+	delete(f.sessions, s.id)
+	f.l.Unlock()
+	f.wg.Done()
+}
+
+// shutdown stops accepting connections and tells every session to close,
+// which sends clients a closing event and closes the session's source, i.e.
+// its Kafka consumers and client. Sessions still open after timeout are cut.
+func (f *flowbro) shutdown(srv *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	f.l.Lock()
+	f.closing = true
+	sessions := []*session{}
+	for _, s := range f.sessions {
+		sessions = append(sessions, s)
+	}
+	f.l.Unlock()
+
+	log.WithFields(log.Fields{"sessions": len(sessions), "timeout": timeout}).Info("Shutting down.")
+	for _, s := range sessions {
+		s.stop()
+	}
+
+	// WebSockets are hijacked connections, so Shutdown doesn't wait for them.
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Could not gracefully shut down HTTP server.")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Info("All sessions closed.")
+		return nil
+	case <-ctx.Done():
+		f.l.Lock()
+		n := len(f.sessions)
+		for _, s := range f.sessions {
+			s.ws.Close()
+		}
+		f.l.Unlock()
+		return fmt.Errorf("Timed out waiting for %v sessions to close", n)
+	}
+}
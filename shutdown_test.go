@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestShutdownClosesSessions(t *testing.T) {
+	f := &flowbro{}
+	template, err := parseBasePageTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := f.server(template, nil)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	ws, err := websocket.Dial(wsURL, "", ts.URL)
+	if err != nil {
+		t.Fatalf("shouldn't have failed connecting, but did with %v", err)
+	}
+	defer ws.Close()
+
+	if err := websocket.JSON.Send(ws, map[string]interface{}{"tutorial": true, "heartbeatUUID": "uuid"}); err != nil {
+		t.Fatal(err)
+	}
+	if !receiveEvent(t, ws, "log") {
+		t.Fatal("expected the session to start")
+	}
+
+	if err := f.shutdown(srv, 2*time.Second); err != nil {
+		t.Errorf("shouldn't have failed shutting down, but did with %v", err)
+	}
+	if !receiveEvent(t, ws, "closing") {
+		t.Error("expected a closing event before the connection closed")
+	}
+	if len(f.sessions) != 0 {
+		t.Errorf("expected every session to be closed; %v still open", len(f.sessions))
+	}
+
+	late, err := websocket.Dial(wsURL, "", ts.URL)
+	if err != nil {
+		return // refused, as expected
+	}
+	defer late.Close()
+	var msg string
+	if err := websocket.Message.Receive(late, &msg); err == nil {
+		t.Errorf("expected sessions started while shutting down to be closed; got %v", msg)
+	}
+}
+
+// receiveEvent reads frames until one has an event of the given type, or the
+// connection closes.
+func receiveEvent(t *testing.T, ws *websocket.Conn, eventType string) bool {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return false
+		}
+
+		var events []event
+		if err := json.Unmarshal([]byte(msg), &events); err != nil {
+			t.Fatalf("couldn't parse %v as events: %v", msg, err)
+		}
+		for _, e := range events {
+			if e.EventType == eventType {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// source produces the messages that a session runs through its rules.
+type source interface {
+	messages() chan *sarama.ConsumerMessage
+	close()
+}
+
+type kafkaSource struct {
+	cluster *cluster
+	c       chan *sarama.ConsumerMessage
+	stop    chan struct{}
+}
+
+func newKafkaSource(c *cluster) *kafkaSource {
+	return &kafkaSource{cluster: c, c: joinMessages(c.chs, c.more, c.closed), stop: make(chan struct{})}
+}
+
+func (s *kafkaSource) messages() chan *sarama.ConsumerMessage { return s.c }
+
+func (s *kafkaSource) close() {
+	close(s.stop)
+	s.cluster.close()
+}
+
+type tutorialSource struct {
+	c    chan *sarama.ConsumerMessage
+	done chan struct{}
+}
+
+func newTutorialSource(script tutorialScript) *tutorialSource {
+	done := make(chan struct{})
+	return &tutorialSource{c: tutorial(script, done), done: done}
+}
+
+func (s *tutorialSource) messages() chan *sarama.ConsumerMessage { return s.c }
+func (s *tutorialSource) close()                                 { close(s.done) }
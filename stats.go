@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+var statsInterval = flag.Duration("stats-interval", 5*time.Second, "how often to send per-partition lag and throughput to the UI; 0 disables it")
+
+// partitionStats tracks what a partition consumer has consumed, so the UI can
+// tell "nothing is happening" apart from "way behind".
+type partitionStats struct {
+	pc        sarama.PartitionConsumer
+	topic     string
+	partition int32
+	start     int64 // offset consumption started from; may be OffsetOldest or OffsetNewest
+	next      int64 // offset of the next message; -1 until known
+	consumed  int64
+	reported  int64 // consumed as of the last report
+	last      time.Time
+}
+
+// partitionStat is what the UI gets for each partition on a stats event.
+type partitionStat struct {
+	Topic       string     `json:"topic"`
+	Partition   int32      `json:"partition"`
+	Lag         int64      `json:"lag"`
+	Rate        float64    `json:"rate"` // messages per second since the last stats event
+	LastMessage *time.Time `json:"lastMessage,omitempty"`
+}
+
+func (c *cluster) track(pc sarama.PartitionConsumer, topic string, partition int32, offset int64) *partitionStats {
+	ps := &partitionStats{pc: pc, topic: topic, partition: partition, start: offset, next: -1}
+	if offset >= 0 {
+		ps.next = offset
+	}
+
+	c.statsLock.Lock()
+	c.stats = append(c.stats, ps)
+	c.statsLock.Unlock()
+	return ps
+}
+
+// resumeOffset is where to pick up consuming if the partition consumer had to
+// be re-created.
+func (ps *partitionStats) resumeOffset() int64 {
+	if ps.next >= 0 {
+		return ps.next
+	}
+	return ps.start
+}
+
+func (c *cluster) consumed(ps *partitionStats, msg *sarama.ConsumerMessage) {
+	c.statsLock.Lock()
+	select {
+	case <-c.closed: // forgetLags may have run already
+	default:
+		recordLag(ps.pc, msg, c.metricLabels)
+	}
+	ps.next = msg.Offset + 1
+	ps.consumed++
+	ps.last = time.Now()
+	c.statsLock.Unlock()
+}
+
+// forgetLags drops the lag metrics of every partition the cluster consumed.
+func (c *cluster) forgetLags() {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	for _, ps := range c.stats {
+		forgetLag(ps.topic, ps.partition, c.metricLabels)
+	}
+}
+
+// partitionStats reports on every partition that is still being consumed,
+// with rates over the given time since the last call.
+func (c *cluster) partitionStats(elapsed time.Duration) []partitionStat {
+	c.pcLock.Lock()
+	active := map[sarama.PartitionConsumer]bool{}
+	for _, pc := range c.partitionConsumers {
+		active[pc] = true
+	}
+	c.pcLock.Unlock()
+
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	stats := []partitionStat{}
+	for _, ps := range c.stats {
+		if !active[ps.pc] {
+			continue
+		}
+
+		s := partitionStat{Topic: ps.topic, Partition: ps.partition}
+		if hwm := ps.pc.HighWaterMarkOffset(); ps.next >= 0 && hwm > ps.next {
+			s.Lag = hwm - ps.next
+		}
+		if elapsed > 0 {
+			s.Rate = float64(ps.consumed-ps.reported) / elapsed.Seconds()
+		}
+		if !ps.last.IsZero() {
+			last := ps.last
+			s.LastMessage = &last
+		}
+		ps.reported = ps.consumed
+
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// reportStats sends a stats event with every partition's lag and throughput
+// every so often, until stop is closed.
+func reportStats(s *session, c *cluster, every time.Duration, stop chan struct{}) {
+	if every <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		now := time.Now()
+		stats := c.partitionStats(now.Sub(last))
+		last = now
+		if len(stats) == 0 {
+			continue
+		}
+
+		if err := s.send(event{EventType: "stats", Stats: stats}); err != nil {
+			return
+		}
+	}
+}
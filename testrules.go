@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// recordedMessage is the on-disk representation of a consumed Kafka message;
+// one per line in a .jsonl file.
+type recordedMessage struct {
+	Key           string          `json:"key"`
+	Value         json.RawMessage `json:"value,omitempty"`         // the JSON payload; missing for tombstones
+	ValueEncoding string          `json:"valueEncoding,omitempty"` // raw if value is a string holding a payload that isn't JSON
+	Topic         string          `json:"topic"`
+	Partition     int32           `json:"partition"`
+	Offset        int64           `json:"offset"`
+	Timestamp     time.Time       `json:"timestamp"`
+}
+
+// consumerMessage converts the recorded message back into what a partition
+// consumer would have produced.
+func (rm recordedMessage) consumerMessage() (*sarama.ConsumerMessage, error) {
+	var value []byte
+	switch {
+	case len(rm.Value) == 0:
+	case rm.ValueEncoding == "raw":
+		var s string
+		if err := json.Unmarshal(rm.Value, &s); err != nil {
+			return nil, fmt.Errorf("Raw value must be a JSON string. err=%v", err)
+		}
+		value = []byte(s)
+	case rm.ValueEncoding == "":
+		value = []byte(rm.Value)
+	default:
+		return nil, fmt.Errorf("Unknown valueEncoding %v", rm.ValueEncoding)
+	}
+
+	return &sarama.ConsumerMessage{
+		Key:       []byte(rm.Key),
+		Value:     value,
+		Topic:     rm.Topic,
+		Partition: rm.Partition,
+		Offset:    rm.Offset,
+		Timestamp: rm.Timestamp,
+	}, nil
+}
+
+func readRecordedMessages(r io.Reader) ([]*sarama.ConsumerMessage, error) {
+	cms := []*sarama.ConsumerMessage{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rm recordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &rm); err != nil {
+			return cms, fmt.Errorf("Could not parse line %v. err=%v", line, err)
+		}
+
+		cm, err := rm.consumerMessage()
+		if err != nil {
+			return cms, fmt.Errorf("Could not parse value on line %v. err=%v", line, err)
+		}
+		cms = append(cms, cm)
+	}
+
+	return cms, scanner.Err()
+}
+
+// dryRun feeds the messages through the config's rules exactly like process
+// does, minus the WebSocket.
+func dryRun(configJSON configJSON, cms []*sarama.ConsumerMessage) ([]event, error) {
+	buffer, now := []message{}, time.Now()
+	for _, cm := range cms {
+		m, err := newMessage(*cm)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse message at %v/%v/%v into message. err=%v", cm.Topic, cm.Partition, cm.Offset, err)
+		}
+		m.defaultTimestamp(now)
+		buffer = append(buffer, m)
+	}
+
+	events, _, err := eventsFrom(buffer, len(buffer), configJSON.Name, configJSON.Rules, map[string]string{}, configJSON.FSMId)
+	return events, err
+}
+
+func testRules(args []string) int {
+	fs := flag.NewFlagSet("test-rules", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the config file whose rules should be tested")
+	messagesPath := fs.String("messages", "", "path to a .jsonl file of recorded messages")
+	fsmId := fs.String("fsm-id", "", "overrides the config's fsmId")
+	goldenPath := fs.String("golden", "", "path to a file with the expected events; fails on mismatch")
+	update := fs.Bool("update", false, "write the resulting events to the golden file instead of comparing")
+	fs.Parse(args)
+
+	if *configPath == "" || *messagesPath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: flowbro test-rules --config config.json --messages messages.jsonl [--golden events.json [--update]]")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	events, err := testRulesFromFiles(*configPath, *messagesPath, *fsmId)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	byt, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while marshalling events: err=%v\n", err)
+		return 1
+	}
+	byt = append(byt, '\n')
+
+	if *goldenPath == "" {
+		os.Stdout.Write(byt)
+		return 0
+	}
+
+	if *update {
+		if err := ioutil.WriteFile(*goldenPath, byt, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write golden file. err=%v\n", err)
+			return 1
+		}
+		fmt.Printf("Wrote %v events to %v\n", len(events), *goldenPath)
+		return 0
+	}
+
+	golden, err := ioutil.ReadFile(*goldenPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read golden file. err=%v\n", err)
+		return 1
+	}
+
+	equal, err := jsonEqual(golden, byt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not compare against golden file. err=%v\n", err)
+		return 1
+	}
+	if !equal {
+		fmt.Fprintf(os.Stderr, "Events don't match golden file %v. Got:\n%s", *goldenPath, byt)
+		return 1
+	}
+
+	fmt.Printf("OK: %v events match %v\n", len(events), *goldenPath)
+	return 0
+}
+
+func testRulesFromFiles(configPath, messagesPath, fsmId string) ([]event, error) {
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read config. err=%v", err)
+	}
+
+	var configJSON configJSON
+	if err := json.Unmarshal(raw, &configJSON); err != nil {
+		return nil, fmt.Errorf("Could not parse config. err=%v", err)
+	}
+	if fsmId != "" {
+		configJSON.FSMId = fsmId
+	}
+
+	f, err := os.Open(messagesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open messages. err=%v", err)
+	}
+	defer f.Close()
+
+	cms, err := readRecordedMessages(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return dryRun(configJSON, cms)
+}
+
+func jsonEqual(a, b []byte) (bool, error) {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(va, vb), nil
+}
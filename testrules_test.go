@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRecordedMessages(t *testing.T) {
+	input := `{"key":"1","value":{"target":"phone"},"topic":"requests","partition":2,"offset":10,"timestamp":"2017-01-02T15:04:05Z"}
+
+{"key":"2","value":"not json","valueEncoding":"raw","topic":"raw","partition":0,"offset":11}
+{"key":"3","value":"not json","topic":"strings","partition":0,"offset":12}
+{"key":"4","value":null,"topic":"nulls","partition":0,"offset":13}
+{"key":"5","topic":"compacted","partition":0,"offset":14}
+`
+	cms, err := readRecordedMessages(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(cms) != 5 {
+		t.Fatalf("expected 5 messages but got %v", len(cms))
+	}
+	if string(cms[0].Value) != `{"target":"phone"}` || cms[0].Topic != "requests" || cms[0].Partition != 2 || cms[0].Offset != 10 || cms[0].Timestamp.IsZero() {
+		t.Errorf("first message mismatch; got %+v", cms[0])
+	}
+	if string(cms[1].Value) != "not json" || string(cms[1].Key) != "2" {
+		t.Errorf("expected string value to be taken as raw payload; got %+v", cms[1])
+	}
+	if string(cms[2].Value) != `"not json"` {
+		t.Errorf("expected JSON string value to be kept as JSON; got %s", cms[2].Value)
+	}
+	if string(cms[3].Value) != "null" || cms[4].Value != nil {
+		t.Errorf("expected null to be kept and a missing value to be a tombstone; got %s and %s", cms[3].Value, cms[4].Value)
+	}
+
+	if _, err := readRecordedMessages(strings.NewReader(`{"value":{},"valueEncoding":"raw"}`)); err == nil {
+		t.Error("expected a raw value that isn't a string to fail")
+	}
+	if _, err := readRecordedMessages(strings.NewReader("{broken")); err == nil {
+		t.Error("expected invalid line to fail")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	c := configJSON{
+		Rules: []rule{
+			{
+				Patterns: []pattern{{Field: "{{.Topic}}", Pattern: "requests"}},
+				Events:   []event{{EventType: "message", SourceId: "A", TargetId: "{{.Value.target}}", Text: "Hi!", FSMId: "{{.Key}}", NoJSON: true, Aggregate: true}},
+			},
+		},
+	}
+	input := `{"key":"1","value":{"target":"phone"},"topic":"requests"}
+{"key":"1","value":{"target":"phone"},"topic":"requests"}
+{"key":"2","value":{"target":"tablet"},"topic":"requests"}
+{"key":"3","value":{"target":"tablet"},"topic":"ignored"}
+`
+	cms, err := readRecordedMessages(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	actual, err := dryRun(c, cms)
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	expected := []event{
+		{EventType: "message", SourceId: "A", TargetId: "phone", Text: "Hi!", FSMId: "1", JSON: []interface{}{}, Count: 2, Aggregate: true},
+		{EventType: "message", SourceId: "A", TargetId: "tablet", Text: "Hi!", FSMId: "2", JSON: []interface{}{}, Count: 1, Aggregate: true},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("events mismatch; expected %+v but got %+v", expected, actual)
+	}
+
+	c.FSMId = "2"
+	actual, err = dryRun(c, cms)
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(actual) != 1 || actual[0].FSMId != "2" {
+		t.Errorf("expected only events for fsmId 2; got %+v", actual)
+	}
+}
+
+func TestDryRunDefaultsMissingTimestampsLikeProcess(t *testing.T) {
+	c := configJSON{
+		Rules: []rule{
+			{
+				Patterns: []pattern{{Field: "{{.Timestamp.IsZero}}", Pattern: "^false$"}},
+				Events:   []event{{EventType: "message", SourceId: "A", TargetId: "B", Text: "Timestamped", FSMId: "{{.Key}}", NoJSON: true}},
+			},
+		},
+	}
+	cms, err := readRecordedMessages(strings.NewReader(`{"key":"1","value":{},"topic":"requests"}` + "\n"))
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	actual, err := dryRun(c, cms)
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(actual) != 1 {
+		t.Errorf("expected the message without a timestamp to be given one; got %+v", actual)
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	equal, err := jsonEqual([]byte(`[{"a": 1, "b": [1, 2]}]`), []byte("[\n  {\"b\":[1,2],\"a\":1}\n]\n"))
+	if err != nil || !equal {
+		t.Errorf("expected equal; got %v, %v", equal, err)
+	}
+
+	equal, err = jsonEqual([]byte(`[{"a": 1}]`), []byte(`[{"a": 2}]`))
+	if err != nil || equal {
+		t.Errorf("expected not equal; got %v, %v", equal, err)
+	}
+}
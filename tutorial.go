@@ -1,144 +1,143 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"time"
 
 	"github.com/Shopify/sarama"
 )
 
-func tutorial() chan *sarama.ConsumerMessage {
-	c := make(chan *sarama.ConsumerMessage)
+const tutorialsPath = "webroot/tutorials"
+
+// tutorialScript is a scripted sequence of mocked messages, loaded from
+// webroot/tutorials/<name>.json. Steps either push a message, sleep, or repeat
+// a block of nested steps a number of times.
+type tutorialScript struct {
+	Steps []tutorialStep `json:"steps"`
+}
 
-	go pushTutorialMessages(c)
+type tutorialStep struct {
+	Message *recordedMessage `json:"message,omitempty"`
+	Sleep   string           `json:"sleep,omitempty"`
+	Times   int              `json:"times,omitempty"`
+	Steps   []tutorialStep   `json:"steps,omitempty"`
 
-	return c
+	message  *sarama.ConsumerMessage
+	duration time.Duration
 }
 
-func pushTutorialMessages(c chan *sarama.ConsumerMessage) {
-	es := tutorialEvents()
-	i := 0
-	for {
-		if i == len(es) {
-			break
-		}
-		switch es[i].kind {
-		case "sleep":
-			time.Sleep(es[i].duration)
-		case "message":
-			c <- es[i].message
+// tutorialRef is what configs use to pick a tutorial script: either a script
+// name or true for the default one.
+type tutorialRef string
+
+func (t *tutorialRef) UnmarshalJSON(b []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(b, &enabled); err == nil {
+		*t = ""
+		if enabled {
+			*t = "default"
 		}
-		if es[i].repeat > 0 {
-			es[i].repeat -= 1
-			i += es[i].jumpRelative
-			continue
+		return nil
+	}
+
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return fmt.Errorf("tutorial should be either a boolean or a script name")
+	}
+	*t = tutorialRef(name)
+	return nil
+}
+
+func loadTutorialScript(name string) (tutorialScript, error) {
+	var script tutorialScript
+
+	path, err := resolvePath(tutorialsPath, name+".json")
+	if err != nil {
+		return script, err
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return script, fmt.Errorf("Could not read tutorial script %v. err=%v", name, err)
+	}
+
+	if err := json.Unmarshal(raw, &script); err != nil {
+		return script, fmt.Errorf("Could not parse tutorial script %v. err=%v", name, err)
+	}
+
+	if err := compileTutorialSteps(script.Steps); err != nil {
+		return script, fmt.Errorf("Invalid tutorial script %v. err=%v", name, err)
+	}
+
+	return script, nil
+}
+
+func compileTutorialSteps(steps []tutorialStep) error {
+	for i := range steps {
+		s := &steps[i]
+		switch {
+		case s.Message != nil:
+			if len(s.Message.Topic) == 0 {
+				return fmt.Errorf("message on step %v has no topic", i)
+			}
+			cm, err := s.Message.consumerMessage()
+			if err != nil {
+				return fmt.Errorf("message on step %v is invalid: %v", i, err)
+			}
+			s.message = cm
+		case s.Sleep != "":
+			d, err := time.ParseDuration(s.Sleep)
+			if err != nil {
+				return fmt.Errorf("sleep on step %v is invalid: %v", i, err)
+			}
+			s.duration = d
+		case len(s.Steps) > 0:
+			if s.Times < 1 {
+				return fmt.Errorf("repeated block on step %v should have times >= 1", i)
+			}
+			if err := compileTutorialSteps(s.Steps); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("step %v should have one of message, sleep or steps", i)
 		}
-		i++
 	}
+	return nil
 }
 
-type tutorialEvent struct {
-	kind         string
-	duration     time.Duration
-	jumpRelative int
-	repeat       int
-	message      *sarama.ConsumerMessage
+func tutorial(script tutorialScript, done chan struct{}) chan *sarama.ConsumerMessage {
+	c := make(chan *sarama.ConsumerMessage)
+
+	go pushTutorialMessages(c, script.Steps, done)
+
+	return c
 }
 
-func tutorialEvents() []tutorialEvent {
-	return []tutorialEvent{
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"Hi! Thank you for trying Flowbro."}`)}},
-		{kind: "sleep", duration: 8 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"With Flowbro, you can better visualise what your distributed system is doing. Like this:"}`)}},
-		{kind: "sleep", duration: 10 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":"Lorem ipsum"}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":"Lorem ipsum"}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"desktop","message":"Lorem ipsum"}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"desktop","message":"Lorem ipsum"}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":"Lorem ipsum"}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":"Lorem ipsum"}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond, jumpRelative: -8, repeat: 2},
-
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"Flowbro has the following use cases:"}`)}},
-		{kind: "sleep", duration: 5 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"1) Monitoring (in real-time)"}`)}},
-		{kind: "sleep", duration: 5 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"2) Debugging & support (in real-time or after the fact)"}`)}},
-		{kind: "sleep", duration: 5 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"3) Making effective presentations"}`)}},
-		{kind: "sleep", duration: 5 * time.Second},
-
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":"Lorem ipsum"}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond, jumpRelative: -8, repeat: 2},
-
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"Flowbro translates Kafka messages to visual interactions and logs; the mapping is 1 to n, as defined by configured rules."}`)}},
-		{kind: "sleep", duration: 10 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond, jumpRelative: -8, repeat: 2},
-
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"Some tips:"}`)}},
-		{kind: "sleep", duration: 10 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond, jumpRelative: -8, repeat: 2},
-
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"1) use 'aggregate: true' to group messages together and save some CPU, like this:"}`)}},
-		{kind: "sleep", duration: 10 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond, jumpRelative: -8, repeat: 2},
-
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"2) use 'noJSON: true' to not see it below this message"}`)}},
-		{kind: "sleep", duration: 10 * time.Second},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"phone","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"desktop","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "requests", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "notifications", Value: []byte(`{"target":"tablet","message":""}`)}},
-		{kind: "sleep", duration: 500 * time.Millisecond, jumpRelative: -8, repeat: 2},
-
-		{kind: "message", message: &sarama.ConsumerMessage{Topic: "tutorial.messages", Value: []byte(`{"log":"3) learn about fsmId and fsmIdAlias to color-code, filter and track the status of the underlying processes (or FSMs) that your system supports."}`)}},
+func pushTutorialMessages(c chan *sarama.ConsumerMessage, steps []tutorialStep, done chan struct{}) bool {
+	for _, s := range steps {
+		switch {
+		case s.message != nil:
+			m := *s.message
+			select {
+			case c <- &m:
+			case <-done:
+				return false
+			}
+		case s.duration > 0:
+			select {
+			case <-time.After(s.duration):
+			case <-done:
+				return false
+			}
+		case len(s.Steps) > 0:
+			for i := 0; i < s.Times; i++ {
+				if !pushTutorialMessages(c, s.Steps, done) {
+					return false
+				}
+			}
+		}
 	}
+	return true
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTutorialRef(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected tutorialRef
+	}{
+		{raw: `{}`, expected: ""},
+		{raw: `{"tutorial":false}`, expected: ""},
+		{raw: `{"tutorial":true}`, expected: "default"},
+		{raw: `{"tutorial":"onboarding"}`, expected: "onboarding"},
+	}
+
+	for _, ts := range tests {
+		var c configJSON
+		if err := json.Unmarshal([]byte(ts.raw), &c); err != nil {
+			t.Errorf("'%v' shouldn't have failed, but did with %v", ts.raw, err)
+		}
+		if c.Tutorial != ts.expected {
+			t.Errorf("on '%v': expected %q but got %q", ts.raw, ts.expected, c.Tutorial)
+		}
+	}
+
+	var c configJSON
+	if err := json.Unmarshal([]byte(`{"tutorial":1}`), &c); err == nil {
+		t.Error("expected a number to be rejected")
+	}
+}
+
+func TestDefaultTutorialScriptLoads(t *testing.T) {
+	script, err := loadTutorialScript("default")
+	if err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+	if len(script.Steps) == 0 {
+		t.Error("expected default tutorial to have steps")
+	}
+
+	if _, err := loadTutorialScript("../configs/config-example"); err == nil {
+		t.Error("expected loading outside of the tutorials directory to fail")
+	}
+}
+
+func TestCompileTutorialStepsRejectsInvalidSteps(t *testing.T) {
+	tests := []string{
+		`[{}]`,
+		`[{"sleep":"forever"}]`,
+		`[{"message":{"value":{}}}]`,
+		`[{"times":0,"steps":[{"sleep":"1s"}]}]`,
+		`[{"times":2,"steps":[{"sleep":"soon"}]}]`,
+	}
+
+	for _, raw := range tests {
+		var steps []tutorialStep
+		if err := json.Unmarshal([]byte(raw), &steps); err != nil {
+			t.Fatal(err)
+		}
+		if err := compileTutorialSteps(steps); err == nil {
+			t.Errorf("expected '%v' to be rejected", raw)
+		}
+	}
+}
+
+func TestTutorialRepeatsBlocks(t *testing.T) {
+	var script tutorialScript
+	raw := `{"steps":[
+		{"message":{"topic":"a","value":{}}},
+		{"times":2,"steps":[{"message":{"topic":"b","value":{}}},{"sleep":"1ms"},{"message":{"topic":"c","value":{}}}]},
+		{"message":{"topic":"d","value":{}}}
+	]}`
+	if err := json.Unmarshal([]byte(raw), &script); err != nil {
+		t.Fatal(err)
+	}
+	if err := compileTutorialSteps(script.Steps); err != nil {
+		t.Fatalf("shouldn't have failed, but did with %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	c := tutorial(script, done)
+
+	for _, expected := range []string{"a", "b", "c", "b", "c", "d"} {
+		select {
+		case cm := <-c:
+			if cm.Topic != expected {
+				t.Errorf("expected topic %v but got %v", expected, cm.Topic)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for topic %v", expected)
+		}
+	}
+}
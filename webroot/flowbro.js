@@ -8,6 +8,7 @@ const init = (configFile) => {
         xhr.onreadystatechange = function(){
           if(xhr.status == 200 && xhr.readyState == 4){
             config = JSON.parse(xhr.responseText)
+            config.name = configFile
             config.heartbeatUUID = guid()
             console.log(config)
           }
@@ -61,12 +62,19 @@ const log = (message, _color, event) => {
     const header = isFlyingMessage ? `<div class='log-header'>` + fsmIdWrapper + minibox(fromId, event.sourceId) + `<span> → </span>` + minibox(toId, event.targetId) + quantityWrapper + `</div>` : ''
 
     const prettyJson = event.json ? '<pre>' + syntaxHighlight(event.json) + '</pre>' : '';
+    const refs = Array.isArray(event.refs) && event.refs.length
+        ? `<div class='message-refs'>` + event.refs.map((r) => `<a href='#' class='message-ref' data-topic='${r.topic}' data-partition='${r.partition}' data-offset='${r.offset}'>${r.topic}/${r.partition}/${r.offset}</a>`).join('') + '</div>'
+        : ''
 
     const element = document.createElement('div')
     element.id = 'log_' + guid()
     element.className = 'logline'
     element.style.color = color
-    element.innerHTML = header + `<div class='log-content'>` + (message ? message + '<br/>' : '') + prettyJson + '</div>'
+    element.innerHTML = header + `<div class='log-content'>` + (message ? message + '<br/>' : '') + prettyJson + refs + '</div>'
+    element.querySelectorAll('.message-ref').forEach((ref) => ref.onclick = (e) => {
+        e.preventDefault()
+        expandMessageRef(ref)
+    })
     element.dataset.fsmId = event.fsmId
     element.dataset.from = fromId
     element.dataset.to = toId
@@ -96,6 +104,28 @@ const log = (message, _color, event) => {
     }
 }
 
+// expandMessageRef fetches the referenced message and shows it in place of the link.
+const expandMessageRef = (ref) => {
+    const d = ref.dataset
+    const xhr = new XMLHttpRequest()
+    xhr.onreadystatechange = function() {
+        if (xhr.readyState != 4) {
+            return
+        }
+        if (xhr.status != 200) {
+            ref.textContent = `${d.topic}/${d.partition}/${d.offset}: ${xhr.responseText || 'could not fetch message'}`
+            return
+        }
+        const m = JSON.parse(xhr.responseText)
+        const pre = document.createElement('pre')
+        pre.innerHTML = m.isTombstone ? 'tombstone' : syntaxHighlight(JSON.stringify(m.value, undefined, 2))
+        ref.parentNode.replaceChild(pre, ref)
+    }
+    const brokers = encodeURIComponent(config.kafka.brokers)
+    xhr.open("GET", `/api/message?brokers=${brokers}&topic=${encodeURIComponent(d.topic)}&partition=${d.partition}&offset=${d.offset}`, true)
+    xhr.send()
+}
+
 const updateFilters = () => {
     if (filterFSMId || filterIds.length) {
         __('.logline:not([data-always])').forEach((e) => e.style.display = 'none')
@@ -269,10 +299,56 @@ const openWebSocket = () => {
 
 const processUiEvents = (events) => {
     for (event of events) {
+        if (event.eventType == 'stats') {
+            showStats(event.stats)
+            continue
+        }
+        if (event.eventType == 'component-status') {
+            showComponentStatus(event.componentId, event.lag)
+            continue
+        }
+        if (event.eventType == 'closing') {
+            log(event.text, event.color)
+            continue
+        }
         eventQueue.push(event)
     }
 }
 
+const showStats = (stats) => {
+    const now = new Date()
+    _('#stats').innerHTML = stats.map((s) => {
+        const idle = s.lastMessage ? `last ${Math.round((now - new Date(s.lastMessage)) / 1000)}s ago` : 'no messages yet'
+        const title = `${s.topic}/${s.partition}: lag ${s.lag}, ${s.rate.toFixed(1)} msg/s, ${idle}`
+        return `<span class="partition-stats${s.lag > 0 ? ' behind' : ''}" title="${title}">${s.topic}/${s.partition} ${s.lag > 0 ? '&#8987; ' + s.lag.toLocaleString() : '&#10003;'} &middot; ${s.rate.toFixed(1)}/s</span>`
+    }).join('')
+}
+
+const showComponentStatus = (componentId, lags) => {
+    const element = _(`[id='component_${safeId(componentId)}']`)
+    if (!element) {
+        return
+    }
+
+    let badge = element.querySelector('.component-badge')
+    if (!badge) {
+        badge = document.createElement('span')
+        badge.className = 'component-badge'
+        element.appendChild(badge)
+    }
+
+    const lag = lags.reduce((sum, l) => sum + l.lag, 0)
+    const uncommitted = lags.every((l) => l.uncommitted === l.partitions)
+    if (uncommitted) {
+        badge.className = 'component-badge uncommitted'
+        badge.innerHTML = '?'
+    } else {
+        badge.className = `component-badge${lag > 0 ? ' behind' : ''}`
+        badge.innerHTML = lag > 0 ? '&#8987; ' + lag.toLocaleString() : '&#10003;'
+    }
+    badge.title = lags.map((l) => `${l.topic}: lag ${l.lag}${l.uncommitted ? `, ${l.uncommitted} partitions never committed` : ''}`).join('\n')
+}
+
 const loadComponents = (config) => {
     let colorRing = colorGenerator(config.colourPalette)
     for (let i in config.components) {